@@ -1,61 +1,139 @@
 package imazingtosbr
 
 import (
-	"encoding/csv"
+	"context"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/sascha-andres/sbrdata/v2"
 )
 
-// transformCallData reads call data from a CSV reader and transforms it into an sbrdata.Calls structure.
-func (a *Application) transformCallData(csvIn *csv.Reader) (*sbrdata.Calls, FileType, error) {
-	callData := sbrdata.Calls{
-		Call:  make([]sbrdata.Call, 0),
-		Count: "0",
-	}
+// transformCallData reads call data from the conversion and adds the calls to its result
+func (a *Application) transformCallData(ctx context.Context, conv *conversion) error {
+	callData := conv.result.Calls
 
 	for {
-		record, err := csvIn.Read()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := conv.next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, CallHistoryFile, err
+			return err
 		}
 		svc := ""
-		if strings.Contains(record[headerIndexMapCall["Service"]], ":") {
-			serviceData := strings.SplitN(record[headerIndexMapCall["Service"]], ":", 2)
-			svc = serviceData[0]
+		number := conv.value(record, "Number")
+		if strings.Contains(conv.value(record, "Service"), ":") {
+			serviceData := strings.SplitN(conv.value(record, "Service"), ":", 2)
+			svc = conv.loc.canonicalValue(serviceData[0])
+			if strings.TrimSpace(number) == "" {
+				// the service of phone calls ends with the number, e.g. "Phone: +1234567890"
+				number = strings.TrimSpace(serviceData[1])
+			}
 		} else {
-			svc = record[headerIndexMapCall["Service"]]
+			svc = conv.value(record, "Service")
+		}
+		policy := a.callPolicy(svc)
+		if policy == CallSkip {
+			conv.result.SkippedCalls[serviceName(svc)]++
+			continue
 		}
 		date := ""
-		dt, err := time.Parse("2006-01-02 15:04:05", record[headerIndexMapCall["Date"]])
+		dt, err := conv.loc.parseDate(conv.value(record, "Date"))
 		if err != nil {
-			return nil, CallHistoryFile, err
+			if err := conv.invalidValue(record, "Date", err); err != nil {
+				return err
+			}
+			continue
+		}
+		date = fmt.Sprintf("%d", conv.localTime(dt).UnixMilli())
+		duration, err := parseDuration(conv.value(record, "Duration"))
+		if err != nil {
+			conv.warn("%s, importing with a duration of 0 seconds", err)
+		}
+		contactName := conv.value(record, "Contact")
+		presentation := callPresentation(conv, number, contactName)
+		if presentation != sbrPresentationAllowed {
+			// the placeholder is not a number
+			number = ""
+		}
+		if _, ok := placeholderPresentation(conv, contactName); ok {
+			// the placeholder is not a name
+			contactName = ""
+		}
+		if contactName == "" {
+			contactName, _ = a.contactName(number)
 		}
-		date = fmt.Sprintf("%d", dt.UnixMilli())
 		call := sbrdata.Call{
-			ContactName:  record[headerIndexMapCall["Contact"]],
+			ContactName:  contactName,
 			Date:         date,
-			ReadableDate: record[headerIndexMapCall["Date"]],
-			Presentation: record[headerIndexMapCall["Contact"]],
-			Duration:     record[headerIndexMapCall["Duration"]],
+			ReadableDate: dt.Format(readableDateLayout),
+			Presentation: presentation,
+			Duration:     strconv.Itoa(duration),
 			DataFrom:     str2Ptr("iMazing"),
 			ServiceType:  str2Ptr(svc),
-			Number:       record[headerIndexMapCall["Number"]],
+			Number:       a.normalizeNumber(number),
 		}
-		if record[headerIndexMapCall["Call Type"]] == callTypeOutgoing {
-			call.Type = "2"
-		} else {
-			call.Type = "1"
+		call.Type = callType(conv, conv.value(record, "Call type"))
+		if policy == CallRewrite {
+			conv.result.RewrittenCalls[serviceName(svc)]++
+			call.Number = ""
+			call.Presentation = sbrPresentationUnknown
 		}
 		callData.Call = append(callData.Call, call)
+		if err := conv.flush(); err != nil {
+			return err
+		}
+	}
+
+	callData.Count = fmt.Sprintf("%d", conv.streamed+len(callData.Call))
+	return nil
+}
+
+// callType maps the iMazing call type to the SBR call type. Unknown call types are
+// reported as a warning and imported as incoming calls.
+func callType(conv *conversion, value string) string {
+	canonical := conv.loc.canonicalValue(value)
+	for k, t := range callTypes {
+		if strings.EqualFold(k, strings.TrimSpace(canonical)) {
+			return t
+		}
+	}
+	conv.warn("unknown call type %q, importing as incoming call", value)
+	return sbrCallTypeIncoming
+}
+
+// callPresentation returns the SBR caller ID presentation of a call. Calls with a phone
+// number are presented. Calls without number are from unknown callers, unless the number
+// or, if there is no number, the contact is a placeholder like "No Caller ID" for a
+// withheld number.
+func callPresentation(conv *conversion, number, contactName string) string {
+	if isPhoneNumber(strings.TrimSpace(number)) {
+		return sbrPresentationAllowed
 	}
+	if p, ok := placeholderPresentation(conv, number); ok {
+		return p
+	}
+	if strings.TrimSpace(number) != "" {
+		return sbrPresentationAllowed
+	}
+	if p, ok := placeholderPresentation(conv, contactName); ok {
+		return p
+	}
+	return sbrPresentationUnknown
+}
 
-	callData.Count = fmt.Sprintf("%d", len(callData.Call))
-	return &callData, CallHistoryFile, nil
+// placeholderPresentation returns the SBR presentation if v is a placeholder for a number
+func placeholderPresentation(conv *conversion, v string) (string, bool) {
+	canonical := strings.TrimSpace(conv.loc.canonicalValue(v))
+	for k, p := range presentations {
+		if strings.EqualFold(k, canonical) {
+			return p, true
+		}
+	}
+	return "", false
 }
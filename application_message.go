@@ -1,52 +1,247 @@
 package imazingtosbr
 
 import (
-	"encoding/csv"
+	"context"
 	"fmt"
 	"io"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/sascha-andres/sbrdata/v2"
 )
 
-func (a *Application) transformMessageData(csvIn *csv.Reader) (any, FileType, error) {
-	messageData := &sbrdata.Messages{
-		Sms: make([]sbrdata.SMS, 0),
-		Mms: make([]sbrdata.MMS, 0),
-	}
+const (
+	// MMS message boxes
+	mmsMsgBoxInbox = "1"
+	mmsMsgBoxSent  = "2"
+	// MMS message types, retrieve-conf for received and send-req for sent messages
+	mmsTypeReceived = "132"
+	mmsTypeSent     = "128"
+	// MMS address types
+	mmsAddrFrom = "137"
+	mmsAddrTo   = "151"
+	// mmsOwnAddress is used by SBR for the address of the device owner
+	mmsOwnAddress = "insert-address-token"
+	// charsetUTF8 is the MIBenum of UTF-8
+	charsetUTF8 = "106"
+
+	// SBR message status codes
+	sbrStatusNone     = "-1"
+	sbrStatusComplete = "0"
+	sbrStatusPending  = "32"
+	sbrStatusFailed   = "64"
+)
+
+// messageStatuses maps the canonical iMazing message status to SBR status codes
+var messageStatuses = map[string]string{
+	"":              sbrStatusNone,
+	"Sent":          sbrStatusNone,
+	"Received":      sbrStatusNone,
+	"Unread":        sbrStatusNone,
+	"Delivered":     sbrStatusComplete,
+	"Read":          sbrStatusComplete,
+	"Played":        sbrStatusComplete,
+	"Sending":       sbrStatusPending,
+	"Pending":       sbrStatusPending,
+	"Failed":        sbrStatusFailed,
+	"Not Delivered": sbrStatusFailed,
+}
+
+// transformMessageData reads message data from the conversion and adds the messages to its result
+func (a *Application) transformMessageData(ctx context.Context, conv *conversion) error {
+	messageData := conv.result.Messages
 
 	for {
-		record, err := csvIn.Read()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := conv.next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, CallHistoryFile, err
+			return err
 		}
 		sms := sbrdata.SMS{}
-		if record[headerIndexMapMessages["Type"]] == callTypeOutgoing {
+		if conv.loc.canonicalValue(conv.value(record, "Type")) == callTypeOutgoing {
 			sms.Type = "2"
 		} else {
 			sms.Type = "1"
 		}
-		sms.ContactName = record[headerIndexMapMessages["Sender Name"]]
-		if sms.ContactName == "" {
-			sms.ContactName = record[headerIndexMapMessages["Chat Session"]]
-		}
+		sms.ContactName = a.messageContactName(conv.value(record, "Sender Name"), conv.value(record, "Sender ID"), conv.value(record, "Chat Session"))
 		date := ""
-		dt, err := time.Parse("2006-01-02 15:04:05", record[headerIndexMapMessages["Message Date"]])
+		dt, err := conv.loc.parseDate(conv.value(record, "Message Date"))
 		if err != nil {
-			return nil, CallHistoryFile, err
+			if err := conv.invalidValue(record, "Message Date", err); err != nil {
+				return err
+			}
+			continue
 		}
-		date = fmt.Sprintf("%d", dt.UnixMilli())
-		sms.Subject = record[headerIndexMapMessages["Subject"]]
-		sms.Body = record[headerIndexMapMessages["Text"]]
-		sms.ReadableDate = record[headerIndexMapMessages["Message Date"]]
+		date = fmt.Sprintf("%d", conv.localTime(dt).UnixMilli())
+		sms.Subject = conv.value(record, "Subject")
+		sms.Body = conv.value(record, "Text")
+		sms.ReadableDate = dt.Format(readableDateLayout)
 		sms.Date = date
-		sms.Address = record[headerIndexMapMessages["Sender ID"]]
-		sms.Status = record[headerIndexMapMessages["Status"]]
-		messageData.Sms = append(messageData.Sms, sms)
+		sms.Address = a.normalizeNumber(conv.value(record, "Sender ID"))
+		status := conv.loc.canonicalValue(conv.value(record, "Status"))
+		sms.Status = messageStatus(conv, status)
+		sms.Read = messageRead(sms.Type, conv.value(record, "Read Date"), status)
+		sms.DateSent = optionalTimestamp(conv, "Delivered Date", conv.value(record, "Delivered Date"))
+
+		if err := a.finishPreviousSession(conv, conv.value(record, "Chat Session")); err != nil {
+			return err
+		}
+		session := conv.session(conv.value(record, "Chat Session"))
+		if sms.Type != "2" {
+			session.addSender(sms.Address)
+		}
+		sender := sms.ContactName
+		if sms.Type == "2" {
+			sender = "me"
+		}
+		if a.handleTapback(conv, session, sms.Body, sender) {
+			continue
+		}
+
+		message := sessionMessage{date: sms.Date, address: sms.Address, body: sms.Body, sms: -1, mms: -1}
+		if reference := conv.value(record, "Replying to"); reference != "" {
+			sms.Body = a.resolveReply(conv, session, sms.Date, reference, sms.Body)
+		}
+
+		if reference := conv.value(record, "Attachment"); reference != "" {
+			mms := newMMS(sms)
+			a.addAttachment(conv, &mms, reference, conv.value(record, "Attachment type"))
+			message.mms = len(messageData.Mms)
+			message.attachment = true
+			session.mms = append(session.mms, len(messageData.Mms))
+			messageData.Mms = append(messageData.Mms, mms)
+		} else {
+			message.sms = len(messageData.Sms)
+			session.sms = append(session.sms, len(messageData.Sms))
+			messageData.Sms = append(messageData.Sms, sms)
+		}
+		session.addMessage(message)
 	}
 
-	return messageData, MessageHistoryFile, nil
+	a.finishSessions(conv, conv.sessionOrder)
+	if err := conv.flush(); err != nil {
+		return err
+	}
+
+	messageData.Count = fmt.Sprintf("%d", conv.streamed+len(messageData.Sms)+len(messageData.Mms))
+	return nil
+}
+
+// messageContactName returns the name of the sender, looked up in the contacts if the
+// export has none. The name of the chat session is used as a fallback.
+func (a *Application) messageContactName(senderName, senderID, chatSession string) string {
+	if senderName != "" {
+		return senderName
+	}
+	if name, ok := a.contactName(senderID); ok {
+		return name
+	}
+	if name, ok := a.contactName(chatSession); ok {
+		return name
+	}
+	return chatSession
+}
+
+// newMMS creates a MMS from the message, with the text of the message as its only part
+func newMMS(sms sbrdata.SMS) sbrdata.MMS {
+	mms := sbrdata.MMS{
+		Date:         sms.Date,
+		DateSent:     sms.DateSent,
+		Address:      sms.Address,
+		ContactName:  sms.ContactName,
+		ReadableDate: sms.ReadableDate,
+		Sub:          sms.Subject,
+		CtT:          "application/vnd.wap.multipart.related",
+		Read:         sms.Read,
+		Seen:         "1",
+		TextOnly:     "1",
+		MsgBox:       mmsMsgBoxInbox,
+		MType:        mmsTypeReceived,
+		Parts:        sbrdata.Parts{Part: make([]sbrdata.Part, 0, 2)},
+		Addrs:        sbrdata.Addrs{Addr: make([]sbrdata.Addr, 0, 2)},
+	}
+	if sms.Type == "2" {
+		mms.MsgBox = mmsMsgBoxSent
+		mms.MType = mmsTypeSent
+		mms.Addrs.Addr = append(mms.Addrs.Addr,
+			sbrdata.Addr{Address: mmsOwnAddress, Type: mmsAddrFrom, Charset: charsetUTF8},
+			sbrdata.Addr{Address: sms.Address, Type: mmsAddrTo, Charset: charsetUTF8})
+	} else {
+		mms.Addrs.Addr = append(mms.Addrs.Addr,
+			sbrdata.Addr{Address: sms.Address, Type: mmsAddrFrom, Charset: charsetUTF8})
+	}
+
+	if sms.Body != "" {
+		mms.Parts.Part = append(mms.Parts.Part, sbrdata.Part{
+			Seq:      "0",
+			Ct:       "text/plain",
+			Name:     "text.txt",
+			Chset:    charsetUTF8,
+			Cl:       "text.txt",
+			AttrText: sms.Body,
+		})
+	}
+	return mms
+}
+
+// addAttachment adds the referenced attachment as a part of the MMS. A missing
+// attachment is reported as a warning, the message is kept with its text.
+//
+// The collection format has no field for the content of a part, so the attachment
+// is referenced by name and size only.
+func (a *Application) addAttachment(conv *conversion, mms *sbrdata.MMS, reference, attachmentType string) {
+	att, err := resolveAttachment(conv.attachments, reference, attachmentType)
+	if err != nil {
+		conv.warn("attachment %q not found, importing message without it: %s", reference, err)
+		return
+	}
+	mms.Parts.Part = append(mms.Parts.Part, sbrdata.Part{
+		Seq:  strconv.Itoa(len(mms.Parts.Part)),
+		Ct:   att.contentType,
+		Name: att.name,
+		Fn:   att.name,
+		Cl:   att.name,
+	})
+	mms.MSize = strconv.FormatInt(att.size, 10)
+	mms.TextOnly = "0"
+}
+
+// messageStatus maps the iMazing message status to the SBR status code. Unknown
+// statuses are reported as a warning and imported without status.
+func messageStatus(conv *conversion, status string) string {
+	for k, code := range messageStatuses {
+		if strings.EqualFold(k, strings.TrimSpace(status)) {
+			return code
+		}
+	}
+	conv.warn("unknown message status %q, importing without status", status)
+	return sbrStatusNone
+}
+
+// messageRead returns "1" if the message has been read. Outgoing messages are always
+// read, incoming messages if they have a read date or are marked as read.
+func messageRead(messageType, readDate, status string) string {
+	if messageType == "2" || strings.TrimSpace(readDate) != "" || strings.EqualFold(status, "Read") {
+		return "1"
+	}
+	return "0"
+}
+
+// optionalTimestamp converts the value of an optional date column to milliseconds since
+// the epoch. Empty and unparsable values result in "0", the latter with a warning.
+func optionalTimestamp(conv *conversion, column, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "0"
+	}
+	dt, err := conv.loc.parseDate(value)
+	if err != nil {
+		conv.warn("invalid %s %q, ignoring it", column, value)
+		return "0"
+	}
+	return strconv.FormatInt(conv.localTime(dt).UnixMilli(), 10)
 }
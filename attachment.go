@@ -0,0 +1,66 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+)
+
+// defaultAttachmentType is used when the type of an attachment cannot be determined
+const defaultAttachmentType = "application/octet-stream"
+
+// attachment is a file referenced by a message of the export
+type attachment struct {
+	// name of the attachment file
+	name string
+	// contentType is the MIME type of the attachment
+	contentType string
+	// size of the attachment in bytes
+	size int64
+}
+
+// resolveAttachment locates the attachment referenced by a message in fsys. iMazing
+// references attachments by file name, optionally with a path relative to the export;
+// both the path and the plain file name are tried.
+func resolveAttachment(fsys fs.FS, reference, attachmentType string) (*attachment, error) {
+	if fsys == nil {
+		return nil, fs.ErrNotExist
+	}
+	reference = strings.ReplaceAll(strings.TrimSpace(reference), "\\", "/")
+	candidates := []string{path.Clean(strings.TrimPrefix(reference, "/")), path.Base(reference)}
+	for _, candidate := range candidates {
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+		info, err := fs.Stat(fsys, candidate)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &attachment{
+			name:        path.Base(candidate),
+			contentType: attachmentContentType(candidate, attachmentType),
+			size:        info.Size(),
+		}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+// attachmentContentType returns the MIME type of an attachment. The "Attachment type"
+// column is used if it holds a MIME type, otherwise the type is derived from the extension.
+func attachmentContentType(name, attachmentType string) string {
+	attachmentType = strings.TrimSpace(attachmentType)
+	if strings.Contains(attachmentType, "/") {
+		return strings.ToLower(attachmentType)
+	}
+	if t := mime.TypeByExtension(strings.ToLower(path.Ext(name))); t != "" {
+		if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+			return mediaType
+		}
+	}
+	return defaultAttachmentType
+}
@@ -0,0 +1,144 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrNoImportFiles is returned when the paths to import do not match any file
+var ErrNoImportFiles = errors.New("no import files found")
+
+// FileResult reports the outcome of importing one of several files
+type FileResult struct {
+	// File is the path of the import file
+	File string
+	// Result of the conversion, nil if the file cannot be converted
+	Result *ConversionResult
+	// Stats of appending the records of the file to the collection
+	Stats AppendStats
+	// Err is the error the file cannot be converted with
+	Err error
+}
+
+// newFileResult creates the result of a converted file, the skipped rows name the file
+func newFileResult(file string, result *ConversionResult, stats AppendStats) FileResult {
+	for _, row := range result.SkippedRows {
+		row.File = file
+	}
+	return FileResult{File: file, Result: result, Stats: stats}
+}
+
+// FindImportFiles returns the files to import for a list of paths. A path is a file, a
+// directory whose CSV files and ZIP archives are imported including those of
+// subdirectories, or a glob pattern like "export/*.csv". Files are returned in order of
+// the paths, the files of a directory sorted by name, and each file only once.
+func FindImportFiles(paths ...string) ([]string, error) {
+	files := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	for _, path := range paths {
+		matches := []string{path}
+		if strings.ContainsAny(path, "*?[") {
+			var err error
+			matches, err = filepath.Glob(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrImportFileDoesNotExist, match)
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+			dirFiles, err := findImportFiles(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range dirFiles {
+				add(file)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNoImportFiles
+	}
+	return files, nil
+}
+
+// findImportFiles returns the CSV files and ZIP archives of the directory and its
+// subdirectories sorted by name
+func findImportFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (strings.EqualFold(filepath.Ext(path), ".csv") || isZipFile(path)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// ImportFiles converts the files and appends their records to the collection, which is
+// loaded and saved only once. The file type of each file is detected from its header row,
+// each CSV file of a ZIP archive is imported like a file of its own and skipped with a
+// warning if it is no export. A file that cannot be converted is reported in its FileResult
+// and does not stop the import of the other files.
+func (a *Application) ImportFiles(files ...string) ([]FileResult, error) {
+	collection, err := a.Collection()
+	if err != nil {
+		return nil, err
+	}
+	known := knownRecords(collection)
+
+	results := make([]FileResult, 0, len(files))
+	for _, file := range files {
+		sources, closeSources, err := a.importSources(file)
+		if err != nil {
+			a.l.Debug("skipping file", "file", file, "err", err)
+			results = append(results, FileResult{File: file, Err: err})
+			continue
+		}
+		for _, src := range sources {
+			result, err := a.convertSource(src, nil)
+			if err != nil {
+				a.l.Debug("skipping file", "file", src.name, "err", err)
+				results = append(results, FileResult{File: src.name, Err: err})
+				continue
+			}
+			stats, err := a.appendRecords(collection, known, result)
+			if err != nil {
+				_ = closeSources()
+				return results, err
+			}
+			results = append(results, newFileResult(src.name, result, stats))
+		}
+		if err := closeSources(); err != nil {
+			a.l.Error("error closing file", "err", err)
+		}
+	}
+
+	return results, a.saveCollection()
+}
@@ -0,0 +1,111 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrUnknownCallPolicy is returned when a call policy is requested that is not supported
+var ErrUnknownCallPolicy = errors.New("unknown call policy")
+
+// defaultCallService is the service name that sets the policy of all services without their own policy
+const defaultCallService = "*"
+
+// CallPolicy determines how calls of a service like FaceTime, Teams or Signal are imported
+type CallPolicy uint
+
+const (
+	// CallImport imports the calls unchanged
+	CallImport CallPolicy = iota
+	// CallSkip does not import the calls
+	CallSkip
+	// CallRewrite imports the calls without number and with an unknown presentation, so
+	// handles like meeting names or UUIDs do not end up in the call log as phone numbers
+	CallRewrite
+)
+
+// String returns the name of the policy
+func (p CallPolicy) String() string {
+	switch p {
+	case CallSkip:
+		return "skip"
+	case CallRewrite:
+		return "rewrite"
+	default:
+		return "import"
+	}
+}
+
+// ParseCallPolicy returns the policy with the given name
+func ParseCallPolicy(name string) (CallPolicy, error) {
+	for _, p := range []CallPolicy{CallImport, CallSkip, CallRewrite} {
+		if strings.EqualFold(p.String(), strings.TrimSpace(name)) {
+			return p, nil
+		}
+	}
+	return CallImport, fmt.Errorf("%w: %q", ErrUnknownCallPolicy, name)
+}
+
+// ParseCallPolicies parses a list of policies per service like "Teams=skip,Signal=rewrite".
+// The service "*" sets the policy of all services not listed.
+func ParseCallPolicies(spec string) (map[string]CallPolicy, error) {
+	policies := make(map[string]CallPolicy)
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		service, name, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(service) == "" {
+			return nil, fmt.Errorf("%w: %q, expected service=policy", ErrUnknownCallPolicy, entry)
+		}
+		policy, err := ParseCallPolicy(name)
+		if err != nil {
+			return nil, err
+		}
+		policies[strings.TrimSpace(service)] = policy
+	}
+	return policies, nil
+}
+
+// serviceName returns the service without surrounding spaces and without format characters
+// like the left-to-right mark iMazing puts in front of some services, e.g. "\u200eWhatsApp Video"
+func serviceName(service string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, service))
+}
+
+// callPolicy returns the policy for calls of a service. A policy applies to the service
+// with the same name, and to the audio and video variants of the service, e.g. the policy
+// for "Teams" applies to "Teams Audio" and "Teams Video".
+func (a *Application) callPolicy(service string) CallPolicy {
+	service = serviceName(service)
+	base := service
+	if i := strings.LastIndex(service, " "); i >= 0 {
+		switch strings.ToLower(service[i+1:]) {
+		case "audio", "video":
+			base = service[:i]
+		}
+	}
+	var (
+		policy CallPolicy
+		found  bool
+	)
+	for name, p := range a.callPolicies {
+		switch {
+		case strings.EqualFold(name, service):
+			return p
+		case strings.EqualFold(name, base):
+			policy, found = p, true
+		}
+	}
+	if found {
+		return policy
+	}
+	return a.callPolicies[defaultCallService]
+}
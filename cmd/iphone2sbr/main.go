@@ -2,12 +2,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/sascha-andres/reuse/flag"
-	"github.com/sascha-andres/sbrdata/v2"
 
 	"github.com/sascha-andres/imazingtosbr"
 )
@@ -16,11 +20,34 @@ var (
 	logLevel       int
 	importFile     string
 	collectionFile string
+	backups        int
 	tag            string
+	locale         string
+	timezone       string
+	attachmentDir  string
+	replyContext   bool
+	tapbacks       string
+	countryCode    string
+	contactsFile   string
+	callPolicy     string
+	lenient        bool
+	errorReport    string
+	stream         bool
 )
 
 const (
 	appPrefix = "IPHONE2SBR"
+
+	commandImport    = "import"
+	commandListTags  = "list-tags"
+	commandRemoveTag = "remove-tag"
+)
+
+var (
+	// errNoCollectionFile is returned by commands that need a collection file
+	errNoCollectionFile = errors.New("a collection file is required")
+	// errFilesNotImported is returned when some of the import files cannot be converted
+	errFilesNotImported = errors.New("files not imported")
 )
 
 // initializeLogger initializes the logger
@@ -45,56 +72,246 @@ func main() {
 
 	flag.SetEnvPrefix(appPrefix)
 	flag.IntVar(&logLevel, "log-level", 2, "Log level (0=warn, 1=info, 2=debug)")
-	flag.StringVar(&importFile, "import-file", "", "Path to the file to import")
-	flag.StringVar(&collectionFile, "collection-file", "", "Path to the collection file to append to")
-	flag.StringVar(&tag, "tag", "", "Tag to apply to all imported calls")
+	flag.StringVar(&importFile, "import-file", "", "Path to the file, ZIP archive, directory or glob to import, more can follow the import command")
+	flag.StringVar(&collectionFile, "collection-file", "", "Path to the collection file to append to, the collection is written to stdout if empty")
+	flag.IntVar(&backups, "backups", 3, "Number of previous versions of the collection file to keep as backups (collection.json.1 ...)")
+	flag.StringVar(&tag, "tag", "", "Tag to apply to all imported records, or the tag to remove with remove-tag")
+	flag.StringVar(&locale, "locale", "", "Locale of the export (en, de, fr, es), detected from the header if empty")
+	flag.StringVar(&timezone, "timezone", "", "IANA timezone of the exporting device (e.g. Europe/Berlin), defaults to the system timezone")
+	flag.StringVar(&attachmentDir, "attachment-dir", "", "Directory holding the attachments of a message export, defaults to the directory of the import file")
+	flag.BoolVar(&replyContext, "reply-context", false, "Prepend a quote of the message replied to to replies")
+	flag.StringVar(&tapbacks, "tapbacks", "keep", "How to import reactions to messages (keep, drop, fold)")
+	flag.StringVar(&countryCode, "country-code", "", "Country calling code for phone numbers without one (e.g. 49), numbers are normalized to E.164")
+	flag.StringVar(&contactsFile, "contacts", "", "vCard file (.vcf) to look up contact names missing in the export")
+	flag.StringVar(&callPolicy, "call-policy", "", "How to import calls by service, e.g. Teams=skip,Signal=rewrite (import, skip, rewrite; * for all other services)")
+	flag.BoolVar(&lenient, "lenient", false, "Skip rows that cannot be converted and report them instead of failing")
+	flag.StringVar(&errorReport, "error-report", "", "File to write the rows skipped in lenient mode to, defaults to the output file with the extension .errors.json")
+	flag.BoolVar(&stream, "stream", false, "Stream records to the collection instead of converting the whole export in memory, for very large exports")
 	flag.Parse()
 
 	logger := initializeLogger(logLevel)
 	logger.Info("starting application")
-	defer logger.Info("application stopped", "duration_ms", time.Since(start).Milliseconds())
+	defer func() {
+		logger.Info("application stopped", "duration_ms", time.Since(start).Milliseconds())
+	}()
 
 	if logLevel == 2 {
-		logger.Info("input", "import-file", importFile, "collection-file", collectionFile, "tag", tag, "args", os.Args[1:])
+		logger.Info("input", "import-file", importFile, "collection-file", collectionFile, "tag", tag, "locale", locale, "timezone", timezone, "args", os.Args[1:])
 	}
 
-	if err := run(logger, os.Args); err != nil {
+	if err := run(logger, flag.GetVerbs()); err != nil {
 		logger.Error("error running application", "err", err, "duration_ms", time.Since(start).Milliseconds())
 		os.Exit(1)
 	}
 }
 
-// run runs the application
-func run(logger *slog.Logger, _ []string) error {
-	a, err := imazingtosbr.NewApplication(logger,
-		imazingtosbr.WithCsvFile(importFile),
+// run runs the command given as verb, importing files if there is none
+func run(logger *slog.Logger, verbs []string) error {
+	command := commandImport
+	if len(verbs) > 0 {
+		command = verbs[0]
+	}
+	switch command {
+	case commandImport:
+		paths := make([]string, 0, len(verbs))
+		if importFile != "" {
+			paths = append(paths, importFile)
+		}
+		if len(verbs) > 1 {
+			paths = append(paths, verbs[1:]...)
+		}
+		return runImport(logger, paths)
+	case commandListTags:
+		return runListTags(logger)
+	case commandRemoveTag:
+		return runRemoveTag(logger)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// runImport converts the files, directories and globs given as paths and appends them
+// to the collection, which is written once after all files
+func runImport(logger *slog.Logger, paths []string) error {
+	files, err := imazingtosbr.FindImportFiles(paths...)
+	if err != nil {
+		return err
+	}
+	loc := time.Local
+	if timezone != "" {
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return err
+		}
+	}
+	tapbackPolicy, err := imazingtosbr.ParseTapbackPolicy(tapbacks)
+	if err != nil {
+		return err
+	}
+	callPolicies, err := imazingtosbr.ParseCallPolicies(callPolicy)
+	if err != nil {
+		return err
+	}
+	opts := []imazingtosbr.ApplicationOption{
 		imazingtosbr.WithCollectionFile(collectionFile),
-		imazingtosbr.WithTag(tag))
+		imazingtosbr.WithBackups(backups),
+		imazingtosbr.WithTag(tag),
+		imazingtosbr.WithLocale(locale),
+		imazingtosbr.WithTimezone(loc),
+		imazingtosbr.WithAttachmentDir(attachmentDir),
+		imazingtosbr.WithReplyContext(replyContext),
+		imazingtosbr.WithTapbackPolicy(tapbackPolicy),
+		imazingtosbr.WithCountryCode(countryCode),
+		imazingtosbr.WithContactsFile(contactsFile),
+		imazingtosbr.WithLenient(lenient),
+	}
+	for service, policy := range callPolicies {
+		opts = append(opts, imazingtosbr.WithCallPolicy(service, policy))
+	}
+	a, err := imazingtosbr.NewApplication(logger, opts...)
 	if err != nil {
 		return err
 	}
-	sbrData, fileType, err := a.Convert()
+
+	var results []imazingtosbr.FileResult
+	if stream {
+		results, err = a.StreamImportFiles(os.Stdout, files...)
+	} else {
+		results, err = a.ImportFiles(files...)
+	}
 	if err != nil {
 		return err
 	}
-	logger.Info("converted file", "file_type", fileType)
-	if sbrData == nil {
-		logger.Info("no data found")
-		return nil
+
+	var (
+		total    imazingtosbr.AppendStats
+		failed   int
+		imported int
+		skipped  = &imazingtosbr.ConversionResult{}
+	)
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			logger.Error("file not imported", "file", r.File, "err", r.Err)
+			continue
+		}
+		logFileResult(logger, r, tapbackPolicy)
+		if r.Result.FileType != imazingtosbr.UnknownFile {
+			imported++
+		}
+		total.Added += r.Stats.Added
+		total.Duplicates += r.Stats.Duplicates
+		skipped.SkippedRows = append(skipped.SkippedRows, r.Result.SkippedRows...)
 	}
-	if fileType == imazingtosbr.CallHistoryFile {
-		callData := sbrData.(*sbrdata.Calls)
-		for _, call := range callData.GetCalls() {
-			logger.Debug("call found", "call", call)
+	if err := writeErrorReport(logger, skipped, files[0]); err != nil {
+		return err
+	}
+	logger.Info("appended to collection", "files", imported, "added", total.Added, "duplicates", total.Duplicates, "tag", tag)
+	if !stream {
+		if err := writeCollection(a); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errFilesNotImported, failed, len(results))
+	}
+	return nil
+}
+
+// logFileResult logs the summary of an imported file
+func logFileResult(logger *slog.Logger, r imazingtosbr.FileResult, tapbackPolicy imazingtosbr.TapbackPolicy) {
+	result := r.Result
+	if result.FileType == imazingtosbr.UnknownFile {
+		// a CSV file of an archive that is no export
+		for _, warning := range result.Warnings {
+			logger.Warn("skipped file", "file", r.File, "reason", warning.String())
 		}
-		return a.AppendCalls(callData)
+		return
 	}
-	if fileType == imazingtosbr.MessageHistoryFile {
-		messageData := sbrData.(*sbrdata.Messages)
-		for _, sms := range messageData.GetSms() {
-			logger.Debug("sms found", "sms", sms)
+	logger.Info("imported file", "file", r.File, "file_type", result.FileType, "rows", result.Rows, "calls", result.Calls.GetCount(), "messages", result.Messages.GetCount(), "added", r.Stats.Added, "duplicates", r.Stats.Duplicates, "warnings", len(result.Warnings))
+	for service, count := range result.SkippedCalls {
+		logger.Info("skipped calls", "file", r.File, "service", service, "count", count)
+	}
+	for service, count := range result.RewrittenCalls {
+		logger.Info("imported calls without number", "file", r.File, "service", service, "count", count)
+	}
+	if result.FileType == imazingtosbr.MessageHistoryFile {
+		logger.Info("reactions", "file", r.File, "policy", tapbackPolicy, "kept", result.Tapbacks.Kept, "dropped", result.Tapbacks.Dropped, "folded", result.Tapbacks.Folded)
+	}
+	for _, call := range result.Calls.GetCalls() {
+		logger.Debug("call found", "call", call)
+	}
+	for _, sms := range result.Messages.GetSms() {
+		logger.Debug("sms found", "sms", sms)
+	}
+}
+
+// runListTags prints the tags of the collection and the number of records carrying them
+func runListTags(logger *slog.Logger) error {
+	if collectionFile == "" {
+		return errNoCollectionFile
+	}
+	a, err := imazingtosbr.NewApplication(logger, imazingtosbr.WithCollectionFile(collectionFile))
+	if err != nil {
+		return err
+	}
+	tags, err := a.Tags()
+	if err != nil {
+		return err
+	}
+	for _, t := range slices.Sorted(maps.Keys(tags)) {
+		fmt.Printf("%s\t%d\n", t, tags[t])
+	}
+	return nil
+}
+
+// runRemoveTag removes all records carrying the tag from the collection
+func runRemoveTag(logger *slog.Logger) error {
+	if collectionFile == "" {
+		return errNoCollectionFile
+	}
+	a, err := imazingtosbr.NewApplication(logger, imazingtosbr.WithCollectionFile(collectionFile), imazingtosbr.WithBackups(backups))
+	if err != nil {
+		return err
+	}
+	removed, err := a.RemoveTag(tag)
+	if err != nil {
+		return err
+	}
+	logger.Info("removed tagged records", "tag", tag, "removed", removed)
+	return nil
+}
+
+// writeCollection writes the collection to stdout if no collection file is set
+func writeCollection(a *imazingtosbr.Application) error {
+	if collectionFile != "" {
+		return nil
+	}
+	return a.AppendTo(os.Stdout)
+}
+
+// writeErrorReport writes the rows skipped in lenient mode next to the output file, or
+// next to the import file if the collection is written to stdout
+func writeErrorReport(logger *slog.Logger, result *imazingtosbr.ConversionResult, file string) error {
+	if !lenient || len(result.SkippedRows) == 0 {
+		return nil
+	}
+	reportFile := errorReport
+	if reportFile == "" {
+		output := collectionFile
+		if output == "" {
+			output = file
 		}
-		return a.AppendMessages(messageData)
+		reportFile = strings.TrimSuffix(output, filepath.Ext(output)) + ".errors.json"
 	}
-	return errors.New("unsupported file type")
+	f, err := os.Create(reportFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logger.Error("error closing error report", "err", err)
+		}
+	}()
+	logger.Warn("skipped rows", "count", len(result.SkippedRows), "report", reportFile)
+	return result.WriteErrorReport(f)
 }
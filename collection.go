@@ -0,0 +1,185 @@
+package imazingtosbr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/sascha-andres/reuse"
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// AppendStats reports the outcome of appending records to the collection
+type AppendStats struct {
+	// Added is the number of records that were new to the collection
+	Added int
+	// Duplicates is the number of records that were already present and skipped
+	Duplicates int
+}
+
+// AppendCalls adds the calls to the collection, skipping calls already present
+func (a *Application) AppendCalls(calls *sbrdata.Calls) (AppendStats, error) {
+	return a.AppendResult(&ConversionResult{FileType: CallHistoryFile, Calls: calls})
+}
+
+// AppendMessages adds the messages to the collection, skipping messages already present
+func (a *Application) AppendMessages(messages *sbrdata.Messages) (AppendStats, error) {
+	return a.AppendResult(&ConversionResult{FileType: MessageHistoryFile, Messages: messages})
+}
+
+// AppendResult adds all calls and messages of the result to the collection, skipping
+// records already present.
+//
+// Records are identified by date, number, type and duration for calls and by date,
+// address and a hash of the content for messages, so appending overlapping exports
+// is idempotent.
+func (a *Application) AppendResult(result *ConversionResult) (AppendStats, error) {
+	collection, err := a.Collection()
+	if err != nil {
+		return AppendStats{}, err
+	}
+	stats, err := a.appendRecords(collection, knownRecords(collection), result)
+	if err != nil {
+		return stats, err
+	}
+	return stats, a.saveCollection()
+}
+
+// knownRecords returns the identities of all records of the collection
+func knownRecords(collection *sbrdata.Collection) map[string]bool {
+	known := make(map[string]bool, len(collection.Calls)+len(collection.Sms)+len(collection.Mms))
+	for _, c := range collection.Calls {
+		known[callKey(c)] = true
+	}
+	for _, s := range collection.Sms {
+		known[smsKey(s)] = true
+	}
+	for _, m := range collection.Mms {
+		known[mmsKey(m)] = true
+	}
+	return known
+}
+
+// appendRecords adds the records of the result not in known to the collection and to known
+func (a *Application) appendRecords(collection *sbrdata.Collection, known map[string]bool, result *ConversionResult) (AppendStats, error) {
+	var stats AppendStats
+	added := make([]string, 0)
+	isNew := func(key string) bool {
+		if known[key] {
+			stats.Duplicates++
+			return false
+		}
+		known[key] = true
+		added = append(added, key)
+		stats.Added++
+		return true
+	}
+
+	if result.Calls != nil {
+		for _, c := range result.Calls.GetCalls() {
+			if isNew(callKey(c)) {
+				collection.Calls = append(collection.Calls, c)
+			}
+		}
+	}
+	if result.Messages != nil {
+		for _, s := range result.Messages.GetSms() {
+			if isNew(smsKey(s)) {
+				collection.Sms = append(collection.Sms, s)
+			}
+		}
+		for _, m := range result.Messages.GetMms() {
+			if isNew(mmsKey(m)) {
+				collection.Mms = append(collection.Mms, m)
+			}
+		}
+	}
+
+	// only records added by this import carry the tag, so removing it undoes the import
+	if err := a.tagRecords(added); err != nil {
+		return stats, err
+	}
+
+	a.l.Debug("appended records", "added", stats.Added, "duplicates", stats.Duplicates, "tag", a.tag)
+	return stats, nil
+}
+
+// callKey returns the identity of a call
+func callKey(c sbrdata.Call) string {
+	return strings.Join([]string{"call", c.Date, c.Number, c.Type, c.Duration}, "\x00")
+}
+
+// smsKey returns the identity of a SMS
+func smsKey(s sbrdata.SMS) string {
+	return strings.Join([]string{"sms", s.Date, s.Address, contentHash(s.Body)}, "\x00")
+}
+
+// mmsKey returns the identity of a MMS, the content consists of the text and name of all parts
+func mmsKey(m sbrdata.MMS) string {
+	content := make([]string, 0, 2*len(m.Parts.Part))
+	for _, p := range m.Parts.Part {
+		content = append(content, p.AttrText, p.Cl)
+	}
+	return strings.Join([]string{"mms", m.Date, m.Address, contentHash(content...)}, "\x00")
+}
+
+// contentHash returns a hex encoded SHA-256 hash of the content
+func contentHash(content ...string) string {
+	h := sha256.New()
+	for _, c := range content {
+		_, _ = io.WriteString(h, c)
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Collection returns the collection records are appended to. It is loaded from the
+// collection file on first use, or created empty if there is none.
+func (a *Application) Collection() (*sbrdata.Collection, error) {
+	if a.collection != nil {
+		return a.collection, nil
+	}
+	collection := &sbrdata.Collection{
+		Key:   "",
+		Calls: make([]sbrdata.Call, 0),
+		Sms:   make([]sbrdata.SMS, 0),
+		Mms:   make([]sbrdata.MMS, 0),
+	}
+	if a.collectionFile != "" && reuse.FileExists(a.collectionFile) {
+		var err error
+		collection, err = sbrdata.LoadCollection(a.collectionFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.collection = collection
+	return collection, nil
+}
+
+// AppendTo writes the collection to w in the format of the collection file
+func (a *Application) AppendTo(w io.Writer) error {
+	collection, err := a.Collection()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// saveCollection writes the collection and its tag index to the collection file, if one is
+// set. The collection file is replaced atomically, keeping the configured backups.
+func (a *Application) saveCollection() error {
+	if a.collectionFile == "" {
+		return nil
+	}
+	if err := writeFile(a.collectionFile, a.backups, a.AppendTo); err != nil {
+		return err
+	}
+	return a.saveTagIndex()
+}
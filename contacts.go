@@ -0,0 +1,196 @@
+package imazingtosbr
+
+import (
+	"bufio"
+	"io"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+)
+
+// contact is a contact of a vCard file
+type contact struct {
+	// name to display for the contact
+	name string
+	// numbers are the phone numbers of the contact as written in the vCard
+	numbers []string
+	// emails are the email addresses of the contact
+	emails []string
+}
+
+// contactIndex maps normalized phone numbers and lower case email addresses to contact names
+type contactIndex map[string]string
+
+// parseVCards reads all contacts of a vCard file. Contacts without a name are ignored.
+func parseVCards(r io.Reader) ([]contact, error) {
+	lines, err := unfoldVCardLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		contacts []contact
+		current  *contact
+		// structured name, used if the vCard has no formatted name
+		structured string
+	)
+	for _, line := range lines {
+		property, params, value, ok := splitVCardLine(line)
+		if !ok {
+			continue
+		}
+		if strings.Contains(params, "QUOTED-PRINTABLE") {
+			if decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value))); err == nil {
+				value = string(decoded)
+			}
+		}
+		switch property {
+		case "BEGIN":
+			if strings.EqualFold(value, "VCARD") {
+				current = &contact{}
+				structured = ""
+			}
+		case "END":
+			if current == nil || !strings.EqualFold(value, "VCARD") {
+				continue
+			}
+			if current.name == "" {
+				current.name = structured
+			}
+			if current.name != "" {
+				contacts = append(contacts, *current)
+			}
+			current = nil
+		case "FN":
+			if current != nil {
+				current.name = unescapeVCardValue(value)
+			}
+		case "N":
+			if current != nil {
+				structured = structuredName(value)
+			}
+		case "ORG":
+			if current != nil && structured == "" {
+				structured = unescapeVCardValue(strings.SplitN(value, ";", 2)[0])
+			}
+		case "TEL":
+			if current != nil {
+				number := strings.TrimPrefix(unescapeVCardValue(value), "tel:")
+				current.numbers = append(current.numbers, number)
+			}
+		case "EMAIL":
+			if current != nil {
+				current.emails = append(current.emails, unescapeVCardValue(value))
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// unfoldVCardLines returns the logical lines of a vCard file. Lines starting with white
+// space continue the previous line, as do quoted-printable lines ending with "=".
+func unfoldVCardLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(lines) == 0 && strings.HasPrefix(line, "\ufeff") {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		last := len(lines) - 1
+		switch {
+		case last >= 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+			lines[last] += line[1:]
+		case last >= 0 && strings.HasSuffix(lines[last], "=") && strings.Contains(strings.ToUpper(lines[last]), "QUOTED-PRINTABLE"):
+			lines[last] = strings.TrimSuffix(lines[last], "=") + line
+		default:
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// splitVCardLine splits a line like "item1.TEL;type=CELL:+1 555 123 4567" into the upper
+// case property name without group, the upper case parameters and the value
+func splitVCardLine(line string) (string, string, string, bool) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", "", false
+	}
+	property, params, _ := strings.Cut(name, ";")
+	if i := strings.LastIndex(property, "."); i >= 0 {
+		property = property[i+1:]
+	}
+	return strings.ToUpper(strings.TrimSpace(property)), strings.ToUpper(params), strings.TrimSpace(value), true
+}
+
+// structuredName returns the name to display for a structured name
+// "Family;Given;Additional;Prefix;Suffix"
+func structuredName(value string) string {
+	parts := strings.Split(value, ";")
+	order := []int{3, 1, 2, 0, 4}
+	names := make([]string, 0, len(parts))
+	for _, i := range order {
+		if i < len(parts) && strings.TrimSpace(parts[i]) != "" {
+			names = append(names, unescapeVCardValue(strings.TrimSpace(parts[i])))
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// unescapeVCardValue resolves the escape sequences of a vCard text value
+func unescapeVCardValue(v string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(v)
+}
+
+// newContactIndex creates the index of the contacts, phone numbers are normalized with
+// the country code. If several contacts share a number, the first one wins.
+func newContactIndex(contacts []contact, countryCode string) contactIndex {
+	index := make(contactIndex)
+	add := func(key, name string) {
+		if _, ok := index[key]; key != "" && !ok {
+			index[key] = name
+		}
+	}
+	for _, c := range contacts {
+		for _, n := range c.numbers {
+			add(contactKey(n, countryCode), c.name)
+		}
+		for _, e := range c.emails {
+			add(contactKey(e, countryCode), c.name)
+		}
+	}
+	return index
+}
+
+// contactKey returns the key of a phone number or email address in the contact index
+func contactKey(handle, countryCode string) string {
+	handle = strings.TrimSpace(handle)
+	if strings.Contains(handle, "@") {
+		return strings.ToLower(handle)
+	}
+	return normalizeNumber(handle, countryCode)
+}
+
+// contactName returns the name of the contact with the phone number or email address
+func (a *Application) contactName(handle string) (string, bool) {
+	if len(a.contacts) == 0 || strings.TrimSpace(handle) == "" {
+		return "", false
+	}
+	if a.contactNames == nil {
+		a.contactNames = newContactIndex(a.contacts, a.countryCode)
+	}
+	name, ok := a.contactNames[contactKey(handle, a.countryCode)]
+	return name, ok
+}
+
+// readContactsFile reads the contacts of a vCard file
+func readContactsFile(file string) ([]contact, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return parseVCards(f)
+}
@@ -0,0 +1,205 @@
+package imazingtosbr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// ConversionResult holds everything a conversion produced
+type ConversionResult struct {
+	// FileType is the detected type of the export
+	FileType FileType
+	// Calls converted from a call history export, empty for other exports
+	Calls *sbrdata.Calls
+	// Messages converted from a message export, empty for other exports
+	Messages *sbrdata.Messages
+	// Rows is the number of data rows read from the export
+	Rows int
+	// SkippedCalls counts the calls not imported because of their call policy, by service
+	SkippedCalls map[string]int
+	// RewrittenCalls counts the calls imported without number because of their call policy, by service
+	RewrittenCalls map[string]int
+	// Tapbacks counts the reactions to messages by how they were handled
+	Tapbacks TapbackStats
+	// Replies links replies to the messages they refer to
+	Replies []Reply
+	// Warnings lists problems that did not stop the conversion
+	Warnings []Warning
+	// SkippedRows lists the rows not converted because of errors, only in lenient mode
+	SkippedRows []*RowError
+}
+
+// Warning describes a problem in the export that did not stop the conversion
+type Warning struct {
+	// Line of the CSV file the warning refers to, 0 if it refers to the whole file
+	Line int
+	// Message describes the problem
+	Message string
+}
+
+// String returns the warning including the line number, if any
+func (w Warning) String() string {
+	if w.Line == 0 {
+		return w.Message
+	}
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+// RowError describes a row of the export that cannot be converted
+type RowError struct {
+	// File is the import file holding the row, only set when importing several files
+	File string `json:"file,omitempty"`
+	// Line of the CSV file the row starts at
+	Line int `json:"line"`
+	// Column holding the invalid value, empty if the row as a whole is invalid
+	Column string `json:"column,omitempty"`
+	// Value is the raw value of the column
+	Value string `json:"value,omitempty"`
+	// Reason describes why the row cannot be converted
+	Reason string `json:"reason"`
+	// Err is the underlying error
+	Err error `json:"-"`
+}
+
+// Error returns the error including the line number and column
+func (e *RowError) Error() string {
+	msg := fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+	if e.Column != "" {
+		msg = fmt.Sprintf("line %d: column %q: %s", e.Line, e.Column, e.Reason)
+	}
+	if e.File != "" {
+		return e.File + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// WriteErrorReport writes the rows skipped in lenient mode as JSON to w
+func (r *ConversionResult) WriteErrorReport(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.SkippedRows)
+}
+
+// newConversionResult creates an empty result for the file type
+func newConversionResult(fileType FileType) *ConversionResult {
+	return &ConversionResult{
+		FileType: fileType,
+		Calls: &sbrdata.Calls{
+			Call:  make([]sbrdata.Call, 0),
+			Count: "0",
+		},
+		Messages: &sbrdata.Messages{
+			Sms:   make([]sbrdata.SMS, 0),
+			Mms:   make([]sbrdata.MMS, 0),
+			Count: "0",
+		},
+		SkippedCalls:   make(map[string]int),
+		RewrittenCalls: make(map[string]int),
+		Replies:        make([]Reply, 0),
+		Warnings:       make([]Warning, 0),
+		SkippedRows:    make([]*RowError, 0),
+	}
+}
+
+// conversion holds the state of a single conversion
+type conversion struct {
+	// l logs warnings of the conversion
+	l *slog.Logger
+	// csvIn reads the records of the export
+	csvIn *csv.Reader
+	// columns maps the canonical column names to their index
+	columns columnIndex
+	// loc is the locale of the export
+	loc *locale
+	// timezone of the exporting device
+	timezone *time.Location
+	// attachments holds the attachment files referenced by messages
+	attachments fs.FS
+	// result collects the converted records
+	result *ConversionResult
+	// sessions of a message export by name
+	sessions map[string]*chatSession
+	// sessionOrder lists the session names in order of appearance
+	sessionOrder []string
+	// line of the current record
+	line int
+	// lenient skips rows that cannot be converted instead of failing
+	lenient bool
+	// sink receives the records of a streaming conversion, nil to keep them in the result
+	sink recordSink
+	// streamed is the number of records handed to the sink
+	streamed int
+}
+
+// next reads the next record and keeps track of the line number. In lenient mode
+// malformed records are skipped.
+func (c *conversion) next() ([]string, error) {
+	for {
+		record, err := c.csvIn.Read()
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			c.result.Rows++
+			c.line = parseErr.StartLine
+			rowErr := &RowError{Line: parseErr.StartLine, Reason: parseErr.Err.Error(), Err: err}
+			if !c.lenient {
+				return nil, rowErr
+			}
+			c.skipRow(rowErr)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.line, _ = c.csvIn.FieldPos(0)
+		c.result.Rows++
+		return record, nil
+	}
+}
+
+// invalidValue handles a value of the current row that cannot be converted. In strict
+// mode the returned error stops the conversion, in lenient mode the row is added to the
+// skipped rows and nil is returned, so the caller continues with the next row.
+func (c *conversion) invalidValue(record []string, column string, err error) error {
+	rowErr := &RowError{Line: c.line, Column: column, Value: c.value(record, column), Reason: err.Error(), Err: err}
+	if !c.lenient {
+		return rowErr
+	}
+	c.skipRow(rowErr)
+	return nil
+}
+
+// skipRow records a row skipped in lenient mode and logs it
+func (c *conversion) skipRow(rowErr *RowError) {
+	c.result.SkippedRows = append(c.result.SkippedRows, rowErr)
+	c.l.Warn("skipping row", "line", rowErr.Line, "column", rowErr.Column, "value", rowErr.Value, "reason", rowErr.Reason)
+}
+
+// value returns the value of the named column in record
+func (c *conversion) value(record []string, name string) string {
+	return c.columns.value(record, name)
+}
+
+// warn records a warning for the current line and logs it
+func (c *conversion) warn(format string, args ...any) {
+	c.warnLine(c.line, format, args...)
+}
+
+// warnLine records a warning for the given line and logs it
+func (c *conversion) warnLine(line int, format string, args ...any) {
+	w := Warning{Line: line, Message: fmt.Sprintf(format, args...)}
+	c.result.Warnings = append(c.result.Warnings, w)
+	c.l.Warn(w.Message, "line", w.Line)
+}
@@ -0,0 +1,106 @@
+package imazingtosbr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// durationUnits maps the unit suffixes of durations like "1h 2m 3s" to seconds
+var durationUnits = map[string]float64{
+	"h": 3600, "hr": 3600, "hrs": 3600, "std": 3600, "std.": 3600,
+	"m": 60, "min": 60, "min.": 60, "mins": 60,
+	"s": 1, "sec": 1, "sec.": 1, "secs": 1, "sek": 1, "sek.": 1, "seg": 1, "seg.": 1,
+}
+
+// parseDuration parses a call duration into seconds. Supported formats are
+// HH:MM:SS, MM:SS, plain seconds and unit based durations like "1h 2m 3s".
+// Fractions of a second may use a dot or a comma and are rounded.
+func parseDuration(v string) (int, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	if strings.Contains(v, ":") {
+		return parseClockDuration(v)
+	}
+	if strings.IndexFunc(v, unicode.IsLetter) >= 0 {
+		return parseUnitDuration(v)
+	}
+	seconds, err := parseSeconds(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	return int(math.Round(seconds)), nil
+}
+
+// parseClockDuration parses durations in the form HH:MM:SS or MM:SS
+func parseClockDuration(v string) (int, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	seconds, err := parseSeconds(parts[len(parts)-1])
+	if err != nil || (seconds >= 60 && len(parts) > 1) {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	multiplier := 60
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 || (i > 0 && n >= 60) {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		seconds += float64(n * multiplier)
+		multiplier *= 60
+	}
+	return int(math.Round(seconds)), nil
+}
+
+// parseUnitDuration parses durations in the form "1h 2m 3s" or "2 min 45 sec"
+func parseUnitDuration(v string) (int, error) {
+	fields := strings.Fields(splitDigitsAndLetters(v))
+	if len(fields)%2 != 0 {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	seconds := 0.0
+	for i := 0; i < len(fields); i += 2 {
+		n, err := parseSeconds(fields[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		unit, ok := durationUnits[strings.ToLower(fields[i+1])]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		seconds += n * unit
+	}
+	return int(math.Round(seconds)), nil
+}
+
+// parseSeconds parses a non-negative number of seconds with a dot or comma as decimal separator
+func parseSeconds(v string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(v), ",", ".", 1), 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("negative duration %q", v)
+	}
+	return f, nil
+}
+
+// splitDigitsAndLetters inserts a space between numbers and units, "1h2m" becomes "1 h 2 m"
+func splitDigitsAndLetters(v string) string {
+	var b strings.Builder
+	var prev rune
+	for i, r := range v {
+		if i > 0 && (unicode.IsDigit(prev) && unicode.IsLetter(r) || unicode.IsLetter(prev) && unicode.IsDigit(r)) {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrNegativeBackups is returned when a negative number of backups is requested
+var ErrNegativeBackups = errors.New("number of backups must not be negative")
+
+// writeFile replaces the file with the data written by write. The data is written to a
+// temporary file in the same directory, synced to disk and renamed over the file, so a
+// crash or a full disk leaves either the previous or the new version. Before the file is
+// replaced, the previous versions are kept as backups, file.1 being the most recent.
+func writeFile(name string, backups int, write func(w io.Writer) error) error {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := write(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if info, err := os.Stat(name); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := rotateBackups(name, backups); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// backupFile returns the name of the n-th backup of the file
+func backupFile(name string, n int) string {
+	return name + "." + strconv.Itoa(n)
+}
+
+// rotateBackups shifts the backups of the file by one, dropping the oldest, and keeps the
+// current version as first backup. The file itself stays in place until it is replaced.
+func rotateBackups(name string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backupFile(name, i), backupFile(name, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(backupFile(name, 1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// a hard link keeps the current version without copying it, file systems without
+	// hard links get a copy
+	if err := os.Link(name, backupFile(name, 1)); err == nil {
+		return nil
+	}
+	return copyFile(name, backupFile(name, 1))
+}
+
+// copyFile copies the file to dst, syncing the copy to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir syncs the directory, so a rename in it survives a crash. Syncing is best effort,
+// some platforms do not support syncing directories.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	_ = d.Sync()
+	return d.Close()
+}
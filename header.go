@@ -0,0 +1,88 @@
+package imazingtosbr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MissingColumnsError is returned when required columns are not present in the header row
+type MissingColumnsError struct {
+	// FileType the header was identified as
+	FileType FileType
+	// Columns lists the canonical names of the missing columns
+	Columns []string
+}
+
+// Error implements the error interface
+func (e *MissingColumnsError) Error() string {
+	return fmt.Sprintf("missing required columns: %s", strings.Join(e.Columns, ", "))
+}
+
+// column describes a column of an iMazing export
+type column struct {
+	// name is the canonical (english) header name
+	name string
+	// required columns must be present for a conversion to start
+	required bool
+}
+
+// columnIndex maps canonical column names to their position in a record
+type columnIndex map[string]int
+
+// newColumnIndex builds the column index from the header row. It returns the index,
+// the header names that are not known for the file type and an error if required
+// columns are missing.
+func newColumnIndex(fileType FileType, header []string, columns []column) (columnIndex, []string, error) {
+	known := make(map[string]string, len(columns))
+	for _, c := range columns {
+		known[normalizeHeader(c.name)] = c.name
+	}
+
+	index := make(columnIndex, len(header))
+	unknown := make([]string, 0)
+	for i, h := range header {
+		name, ok := known[normalizeHeader(h)]
+		if !ok {
+			unknown = append(unknown, h)
+			continue
+		}
+		if _, ok := index[name]; ok {
+			// first occurrence wins
+			continue
+		}
+		index[name] = i
+	}
+
+	missing := make([]string, 0)
+	for _, c := range columns {
+		if _, ok := index[c.name]; c.required && !ok {
+			missing = append(missing, c.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, unknown, &MissingColumnsError{FileType: fileType, Columns: missing}
+	}
+
+	return index, unknown, nil
+}
+
+// value returns the value of the named column in record, or an empty string if
+// the column is not part of the export
+func (c columnIndex) value(record []string, name string) string {
+	i, ok := c[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+// has returns true if the named column is part of the export
+func (c columnIndex) has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// normalizeHeader returns the header name in a form suitable for comparison
+func normalizeHeader(h string) string {
+	return strings.ToLower(strings.TrimSpace(h))
+}
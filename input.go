@@ -0,0 +1,165 @@
+package imazingtosbr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// inputBufferSize is the size of the buffer used to detect the format of the input,
+// the delimiter is detected from the part of the header row that fits into it
+const inputBufferSize = 64 * 1024
+
+// delimiters lists the supported field delimiters in order of preference
+var delimiters = []byte{',', ';', '\t'}
+
+// inputFormat describes the encoding and the delimiter detected for a CSV export
+type inputFormat struct {
+	// encoding of the input, one of "utf-8", "utf-16le" and "utf-16be"
+	encoding string
+	// bom is true if the input starts with a byte order mark
+	bom bool
+	// delimiter separating the fields
+	delimiter rune
+}
+
+// delimiterName returns a printable name of the delimiter
+func (f inputFormat) delimiterName() string {
+	if f.delimiter == '\t' {
+		return "tab"
+	}
+	return string(f.delimiter)
+}
+
+// normalizeInput returns a reader that yields the input as UTF-8 without byte order
+// mark, along with the detected format. Exports saved by Excel may be UTF-16 encoded or
+// use a semicolon or a tab as delimiter.
+func normalizeInput(r io.Reader) (io.Reader, inputFormat, error) {
+	format := inputFormat{encoding: "utf-8", delimiter: ','}
+	br := bufio.NewReaderSize(r, inputBufferSize)
+
+	start, err := br.Peek(3)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, format, err
+	}
+	switch {
+	case bytes.HasPrefix(start, []byte{0xEF, 0xBB, 0xBF}):
+		format.bom = true
+		_, _ = br.Discard(3)
+	case bytes.HasPrefix(start, []byte{0xFF, 0xFE}):
+		format.encoding, format.bom = "utf-16le", true
+		_, _ = br.Discard(2)
+	case bytes.HasPrefix(start, []byte{0xFE, 0xFF}):
+		format.encoding, format.bom = "utf-16be", true
+		_, _ = br.Discard(2)
+	case len(start) >= 2 && start[0] != 0 && start[1] == 0:
+		// the header row starts with an ASCII character
+		format.encoding = "utf-16le"
+	case len(start) >= 2 && start[0] == 0 && start[1] != 0:
+		format.encoding = "utf-16be"
+	}
+
+	switch format.encoding {
+	case "utf-16le":
+		br = bufio.NewReaderSize(&utf16Reader{r: br, order: binary.LittleEndian}, inputBufferSize)
+	case "utf-16be":
+		br = bufio.NewReaderSize(&utf16Reader{r: br, order: binary.BigEndian}, inputBufferSize)
+	}
+
+	head, err := br.Peek(inputBufferSize)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, format, err
+	}
+	format.delimiter = sniffDelimiter(head)
+	return br, format, nil
+}
+
+// sniffDelimiter returns the delimiter occurring most often outside of quotes in the
+// first line of the input, the comma if none occurs
+func sniffDelimiter(head []byte) rune {
+	counts := make(map[byte]int, len(delimiters))
+	quoted := false
+	for _, b := range head {
+		if b == '"' {
+			quoted = !quoted
+			continue
+		}
+		if quoted {
+			continue
+		}
+		if b == '\n' {
+			break
+		}
+		counts[b]++
+	}
+	best := delimiters[0]
+	for _, d := range delimiters[1:] {
+		if counts[d] > counts[best] {
+			best = d
+		}
+	}
+	return rune(best)
+}
+
+// utf16Reader decodes UTF-16 input to UTF-8
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	// buf holds decoded data not yet returned
+	buf []byte
+}
+
+// Read implements io.Reader
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.buf) < len(p) {
+		r, err := u.readRune()
+		if err != nil {
+			if len(u.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+		u.buf = utf8.AppendRune(u.buf, r)
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+// readRune decodes the next rune, unpaired surrogates and a trailing odd byte are
+// decoded as the replacement character
+func (u *utf16Reader) readRune() (rune, error) {
+	first, err := u.readUnit()
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(first)) {
+		return rune(first), nil
+	}
+	second, err := u.r.Peek(2)
+	if len(second) < 2 {
+		return utf8.RuneError, nil
+	}
+	r := utf16.DecodeRune(rune(first), rune(u.order.Uint16(second)))
+	if r != utf8.RuneError {
+		_, _ = u.r.Discard(2)
+	}
+	return r, err
+}
+
+// readUnit reads the next UTF-16 code unit
+func (u *utf16Reader) readUnit() (uint16, error) {
+	var unit [2]byte
+	n, err := io.ReadFull(u.r, unit[:])
+	if n == 1 {
+		return utf8.RuneError, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.order.Uint16(unit[:]), nil
+}
@@ -0,0 +1,243 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrUnknownLocale is returned when a locale is requested that is not supported
+var ErrUnknownLocale = errors.New("unknown locale")
+
+// locale describes the header names, values and date layouts of a localized iMazing export
+type locale struct {
+	// name identifies the locale, e.g. "de"
+	name string
+	// headers maps localized header names to canonical header names
+	headers map[string]string
+	// values maps localized enumerated values (call type, message type, status, service, caller ID) to canonical values
+	values map[string]string
+	// dateLayouts are tried in order when parsing timestamps
+	dateLayouts []string
+}
+
+// locales lists the supported locales in detection order
+var locales = []*locale{
+	{
+		name:        "en",
+		headers:     map[string]string{},
+		values:      map[string]string{},
+		dateLayouts: []string{"2006-01-02 15:04:05", "2006-01-02 15:04"},
+	},
+	{
+		name: "de",
+		headers: map[string]string{
+			"Anruftyp":          "Call type",
+			"Datum":             "Date",
+			"Dauer":             "Duration",
+			"Nummer":            "Number",
+			"Kontakt":           "Contact",
+			"Ort":               "Location",
+			"Dienst":            "Service",
+			"Chat-Sitzung":      "Chat Session",
+			"Nachrichtendatum":  "Message Date",
+			"Zustelldatum":      "Delivered Date",
+			"Lesedatum":         "Read Date",
+			"Bearbeitungsdatum": "Edited Date",
+			"Typ":               "Type",
+			"Absender-ID":       "Sender ID",
+			"Absendername":      "Sender Name",
+			"Status":            "Status",
+			"Antwort auf":       "Replying to",
+			"Betreff":           "Subject",
+			"Text":              "Text",
+			"Anhang":            "Attachment",
+			"Anhangstyp":        "Attachment type",
+		},
+		values: map[string]string{
+			"Ausgehend":        "Outgoing",
+			"Eingehend":        "Incoming",
+			"Verpasst":         "Missed",
+			"Mailbox":          "Voicemail",
+			"Abgelehnt":        "Rejected",
+			"Blockiert":        "Blocked",
+			"Abgebrochen":      "Cancelled",
+			"Telefon":          "Phone",
+			"Gesendet":         "Sent",
+			"Empfangen":        "Received",
+			"Ungelesen":        "Unread",
+			"Zugestellt":       "Delivered",
+			"Gelesen":          "Read",
+			"Abgespielt":       "Played",
+			"Wird gesendet":    "Sending",
+			"Fehlgeschlagen":   "Failed",
+			"Nicht zugestellt": "Not Delivered",
+			"Keine Anrufer-ID": "No Caller ID",
+			"Unbekannt":        "Unknown",
+			"Münztelefon":      "Payphone",
+		},
+		dateLayouts: []string{"02.01.2006 15:04:05", "02.01.2006 15:04"},
+	},
+	{
+		name: "fr",
+		headers: map[string]string{
+			"Type d'appel":          "Call type",
+			"Date":                  "Date",
+			"Durée":                 "Duration",
+			"Numéro":                "Number",
+			"Contact":               "Contact",
+			"Lieu":                  "Location",
+			"Service":               "Service",
+			"Session de discussion": "Chat Session",
+			"Date du message":       "Message Date",
+			"Date de livraison":     "Delivered Date",
+			"Date de lecture":       "Read Date",
+			"Date de modification":  "Edited Date",
+			"Type":                  "Type",
+			"ID de l'expéditeur":    "Sender ID",
+			"Nom de l'expéditeur":   "Sender Name",
+			"Statut":                "Status",
+			"En réponse à":          "Replying to",
+			"Objet":                 "Subject",
+			"Texte":                 "Text",
+			"Pièce jointe":          "Attachment",
+			"Type de pièce jointe":  "Attachment type",
+		},
+		values: map[string]string{
+			"Sortant":           "Outgoing",
+			"Entrant":           "Incoming",
+			"Manqué":            "Missed",
+			"Messagerie vocale": "Voicemail",
+			"Refusé":            "Rejected",
+			"Bloqué":            "Blocked",
+			"Annulé":            "Cancelled",
+			"Téléphone":         "Phone",
+			"Envoyé":            "Sent",
+			"Reçu":              "Received",
+			"Non lu":            "Unread",
+			"Distribué":         "Delivered",
+			"Lu":                "Read",
+			"Lu (audio)":        "Played",
+			"Envoi en cours":    "Sending",
+			"Échec":             "Failed",
+			"Non distribué":     "Not Delivered",
+			"Numéro masqué":     "No Caller ID",
+			"Inconnu":           "Unknown",
+			"Cabine publique":   "Payphone",
+		},
+		dateLayouts: []string{"02/01/2006 15:04:05", "02/01/2006 15:04"},
+	},
+	{
+		name: "es",
+		headers: map[string]string{
+			"Tipo de llamada":         "Call type",
+			"Fecha":                   "Date",
+			"Duración":                "Duration",
+			"Número":                  "Number",
+			"Contacto":                "Contact",
+			"Ubicación":               "Location",
+			"Servicio":                "Service",
+			"Sesión de chat":          "Chat Session",
+			"Fecha del mensaje":       "Message Date",
+			"Fecha de entrega":        "Delivered Date",
+			"Fecha de lectura":        "Read Date",
+			"Fecha de edición":        "Edited Date",
+			"Tipo":                    "Type",
+			"ID del remitente":        "Sender ID",
+			"Nombre del remitente":    "Sender Name",
+			"Estado":                  "Status",
+			"Respuesta a":             "Replying to",
+			"Asunto":                  "Subject",
+			"Texto":                   "Text",
+			"Archivo adjunto":         "Attachment",
+			"Tipo de archivo adjunto": "Attachment type",
+		},
+		values: map[string]string{
+			"Saliente":          "Outgoing",
+			"Entrante":          "Incoming",
+			"Perdida":           "Missed",
+			"Buzón de voz":      "Voicemail",
+			"Rechazada":         "Rejected",
+			"Bloqueada":         "Blocked",
+			"Cancelada":         "Cancelled",
+			"Teléfono":          "Phone",
+			"Enviado":           "Sent",
+			"Recibido":          "Received",
+			"No leído":          "Unread",
+			"Entregado":         "Delivered",
+			"Leído":             "Read",
+			"Reproducido":       "Played",
+			"Enviando":          "Sending",
+			"Error":             "Failed",
+			"No entregado":      "Not Delivered",
+			"Sin ID de llamada": "No Caller ID",
+			"Desconocido":       "Unknown",
+			"Teléfono público":  "Payphone",
+		},
+		dateLayouts: []string{"02/01/2006 15:04:05", "02/01/2006 15:04"},
+	},
+}
+
+// lookupLocale returns the locale with the given name
+func lookupLocale(name string) (*locale, error) {
+	for _, l := range locales {
+		if strings.EqualFold(l.name, name) {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownLocale, name)
+}
+
+// detectLocale returns the first locale whose translated header identifies a supported
+// file type, along with the translated header
+func detectLocale(header []string) (*locale, []string) {
+	for _, l := range locales {
+		canonical := l.canonicalHeader(header)
+		if ft, _ := detectFileType(canonical); ft != UnknownFile {
+			return l, canonical
+		}
+	}
+	return nil, header
+}
+
+// canonicalHeader translates the localized header row to canonical header names.
+// Header names without translation are returned unchanged.
+func (l *locale) canonicalHeader(header []string) []string {
+	translations := make(map[string]string, len(l.headers))
+	for k, v := range l.headers {
+		translations[normalizeHeader(k)] = v
+	}
+	result := make([]string, len(header))
+	for i, h := range header {
+		if c, ok := translations[normalizeHeader(h)]; ok {
+			result[i] = c
+			continue
+		}
+		result[i] = h
+	}
+	return result
+}
+
+// canonicalValue translates a localized enumerated value to its canonical form
+func (l *locale) canonicalValue(v string) string {
+	for k, c := range l.values {
+		if strings.EqualFold(k, strings.TrimSpace(v)) {
+			return c
+		}
+	}
+	return v
+}
+
+// parseDate parses a timestamp using the date layouts of the locale
+func (l *locale) parseDate(v string) (time.Time, error) {
+	var err error
+	for _, layout := range l.dateLayouts {
+		var t time.Time
+		t, err = time.Parse(layout, strings.TrimSpace(v))
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,77 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidCountryCode is returned when the default country code is not a valid calling code
+var ErrInvalidCountryCode = errors.New("invalid country code")
+
+// minSubscriberDigits is the minimum number of digits of a number that is not a short code.
+// Short codes are only valid within their network and never get a country code.
+const minSubscriberDigits = 7
+
+// parseCountryCode returns the digits of a country calling code given as "49", "+49" or "0049"
+func parseCountryCode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	code = strings.TrimPrefix(code, "+")
+	code = strings.TrimPrefix(code, "00")
+	if code == "" || len(code) > 3 || code[0] == '0' {
+		return "", ErrInvalidCountryCode
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidCountryCode
+		}
+	}
+	return code, nil
+}
+
+// normalizeNumber returns a phone number in E.164 format. International numbers keep their
+// country code, national numbers get countryCode instead of the trunk prefix. Without a
+// country code, national numbers are only stripped of formatting. Values that are no phone
+// numbers, like email addresses, UUIDs or meeting names, are returned unchanged.
+func normalizeNumber(v, countryCode string) string {
+	trimmed := strings.TrimSpace(v)
+	if !isPhoneNumber(trimmed) {
+		return v
+	}
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, trimmed)
+
+	switch {
+	case strings.HasPrefix(trimmed, "+"):
+		return "+" + digits
+	case strings.HasPrefix(digits, "00"):
+		return "+" + digits[2:]
+	case countryCode == "" || len(digits) < minSubscriberDigits:
+		return digits
+	case strings.HasPrefix(digits, "0"):
+		return "+" + countryCode + digits[1:]
+	case countryCode == "1" && len(digits) == 11 && digits[0] == '1':
+		// the North American trunk prefix is 1, the same as the country code
+		return "+" + digits
+	default:
+		return "+" + countryCode + digits
+	}
+}
+
+// isPhoneNumber returns true if v consists of digits and the characters used to format phone numbers
+func isPhoneNumber(v string) bool {
+	if v == "" || strings.Contains(v, "@") {
+		return false
+	}
+	return isHandle(v)
+}
+
+// normalizeNumber returns a phone number in E.164 format using the default country code
+// of the application
+func (a *Application) normalizeNumber(v string) string {
+	return normalizeNumber(v, a.countryCode)
+}
@@ -0,0 +1,105 @@
+package imazingtosbr
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// replyQuoteLength is the maximum number of characters of the referenced message quoted in a reply
+const replyQuoteLength = 60
+
+// Reply links a message to the message it replies to
+type Reply struct {
+	// Line of the replying message in the CSV file
+	Line int
+	// Date of the replying message in milliseconds since the epoch
+	Date string
+	// Reference is the value of the "Replying to" column
+	Reference string
+	// Found is true if the referenced message is part of the export
+	Found bool
+	// ReplyToDate is the date of the referenced message in milliseconds since the epoch
+	ReplyToDate string
+	// ReplyToAddress is the sender of the referenced message, empty for outgoing messages
+	ReplyToAddress string
+	// ReplyToBody is the text of the referenced message
+	ReplyToBody string
+}
+
+// sessionMessage is a message of a chat session that replies and reactions can refer to
+type sessionMessage struct {
+	date    string
+	address string
+	body    string
+	// attachment is set if the message has an attachment
+	attachment bool
+	// sms is the index of the message in the SMS of the result, -1 if it is a MMS
+	sms int
+	// mms is the index of the message in the MMS of the result, -1 if it is a SMS
+	mms int
+}
+
+// addMessage remembers a message of the session so replies and reactions can be resolved
+func (s *chatSession) addMessage(m sessionMessage) {
+	if m.body == "" && !m.attachment {
+		return
+	}
+	s.messages = append(s.messages, m)
+}
+
+// findMessage returns the most recent message of the session whose text matches the
+// reference. iMazing may shorten the referenced text, so a prefix match is accepted.
+func (s *chatSession) findMessage(reference string) (sessionMessage, bool) {
+	reference = strings.TrimSuffix(strings.TrimSpace(reference), "…")
+	if reference == "" {
+		return sessionMessage{}, false
+	}
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if strings.HasPrefix(s.messages[i].body, reference) {
+			return s.messages[i], true
+		}
+	}
+	return sessionMessage{}, false
+}
+
+// findAttachment returns the most recent message of the session with an attachment
+func (s *chatSession) findAttachment() (sessionMessage, bool) {
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].attachment {
+			return s.messages[i], true
+		}
+	}
+	return sessionMessage{}, false
+}
+
+// resolveReply looks up the message referenced by a reply in the session and records
+// the link in the result. If reply context is enabled, the body is returned with a
+// quote of the referenced message prepended.
+func (a *Application) resolveReply(conv *conversion, s *chatSession, date, reference, body string) string {
+	reply := Reply{Line: conv.line, Date: date, Reference: reference}
+	quoted := reference
+	if m, ok := s.findMessage(reference); ok {
+		reply.Found = true
+		reply.ReplyToDate = m.date
+		reply.ReplyToAddress = m.address
+		reply.ReplyToBody = m.body
+		quoted = m.body
+	} else {
+		conv.warn("message replied to (%q) not found in chat session %q", reference, s.name)
+	}
+	conv.result.Replies = append(conv.result.Replies, reply)
+
+	if !a.replyContext {
+		return body
+	}
+	return "> " + shorten(quoted, replyQuoteLength) + "\n" + body
+}
+
+// shorten returns the first n characters of v on a single line, marking omitted text with an ellipsis
+func shorten(v string, n int) string {
+	v = strings.Join(strings.Fields(v), " ")
+	if utf8.RuneCountInString(v) <= n {
+		return v
+	}
+	return string([]rune(v)[:n]) + "…"
+}
@@ -0,0 +1,194 @@
+package imazingtosbr
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// chatSession collects what is known about a conversation of a message export
+type chatSession struct {
+	// name of the session as given in the "Chat Session" column
+	name string
+	// participants are the distinct sender IDs of incoming messages, in order of appearance
+	participants []string
+	// sms are the indexes of the SMS of the session in the result
+	sms []int
+	// mms are the indexes of the MMS of the session in the result
+	mms []int
+	// messages of the session that replies can refer to
+	messages []sessionMessage
+	// line of the first message of the session
+	line int
+}
+
+// session returns the chat session with the given name, creating it if necessary
+func (c *conversion) session(name string) *chatSession {
+	if c.sessions == nil {
+		c.sessions = make(map[string]*chatSession)
+	}
+	s, ok := c.sessions[name]
+	if !ok {
+		s = &chatSession{name: name, line: c.line}
+		c.sessions[name] = s
+		c.sessionOrder = append(c.sessionOrder, name)
+	}
+	return s
+}
+
+// addSender records the sender of an incoming message
+func (s *chatSession) addSender(id string) {
+	if id != "" && !slices.Contains(s.participants, id) {
+		s.participants = append(s.participants, id)
+	}
+}
+
+// isGroup returns true if the session is a group chat, that is if incoming messages
+// come from more than one sender. The session name is no indication, iMazing names
+// one-to-one sessions by the contact and often leaves the sender name empty.
+func (s *chatSession) isGroup() bool {
+	return len(s.participants) > 1
+}
+
+// isHandle returns true if v looks like a phone number or an email address
+func isHandle(v string) bool {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return false
+	}
+	if strings.Contains(v, "@") {
+		return true
+	}
+	digits := 0
+	for _, r := range v {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case strings.ContainsRune("+-() ./", r):
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// counterpart returns the address of the other party of a one-to-one session. That is
+// the session name if it is a handle, otherwise the only sender of incoming messages.
+func (s *chatSession) counterpart() (string, bool) {
+	if isHandle(s.name) {
+		return strings.TrimSpace(s.name), true
+	}
+	if len(s.participants) == 1 {
+		return s.participants[0], true
+	}
+	return "", false
+}
+
+// finishSessions completes the messages of the sessions once all their messages are known
+func (a *Application) finishSessions(conv *conversion, names []string) {
+	a.resolveOutgoingAddresses(conv, names)
+	a.convertGroupSessions(conv, names)
+}
+
+// resolveOutgoingAddresses sets the address of outgoing messages, which have no sender
+// ID in the export, to the counterpart of their session. Sessions without a known
+// counterpart are reported as warnings.
+func (a *Application) resolveOutgoingAddresses(conv *conversion, names []string) {
+	messageData := conv.result.Messages
+	for _, name := range names {
+		s := conv.sessions[name]
+		if s.isGroup() {
+			// group chats are addressed to all participants
+			continue
+		}
+		address, ok := s.counterpart()
+		address = a.normalizeNumber(address)
+		unresolved := false
+		for _, i := range s.sms {
+			sms := &messageData.Sms[i]
+			if sms.Type != "2" || sms.Address != "" {
+				continue
+			}
+			if !ok {
+				unresolved = true
+				continue
+			}
+			sms.Address = address
+		}
+		for _, i := range s.mms {
+			mms := &messageData.Mms[i]
+			if mms.MsgBox != mmsMsgBoxSent || mms.Address != "" {
+				continue
+			}
+			if !ok {
+				unresolved = true
+				continue
+			}
+			mms.Address = address
+			for j := range mms.Addrs.Addr {
+				if mms.Addrs.Addr[j].Type == mmsAddrTo && mms.Addrs.Addr[j].Address == "" {
+					mms.Addrs.Addr[j].Address = address
+				}
+			}
+		}
+		if unresolved {
+			conv.warnLine(s.line, "cannot determine the address of outgoing messages in chat session %q", s.name)
+		}
+	}
+}
+
+// convertGroupSessions turns all messages of group chats into MMS addressed to every
+// participant, so the conversation stays in a single thread
+func (a *Application) convertGroupSessions(conv *conversion, names []string) {
+	messageData := conv.result.Messages
+	remove := make(map[int]bool)
+	for _, name := range names {
+		s := conv.sessions[name]
+		if !s.isGroup() {
+			continue
+		}
+		for _, i := range s.sms {
+			sms := messageData.Sms[i]
+			mms := newMMS(sms)
+			addressGroupMMS(&mms, sms.Address, sms.Type == "2", s)
+			messageData.Mms = append(messageData.Mms, mms)
+			remove[i] = true
+		}
+		for _, i := range s.mms {
+			mms := &messageData.Mms[i]
+			addressGroupMMS(mms, mms.Address, mms.MsgBox == mmsMsgBoxSent, s)
+		}
+	}
+	if len(remove) == 0 {
+		return
+	}
+	sms := make([]sbrdata.SMS, 0, len(messageData.Sms)-len(remove))
+	for i, s := range messageData.Sms {
+		if !remove[i] {
+			sms = append(sms, s)
+		}
+	}
+	messageData.Sms = sms
+}
+
+// addressGroupMMS sets the addresses of a group chat MMS. Incoming messages are from
+// their sender to all other participants, outgoing messages to all participants.
+func addressGroupMMS(mms *sbrdata.MMS, sender string, outgoing bool, s *chatSession) {
+	mms.Address = strings.Join(s.participants, "~")
+	mms.ContactName = s.name
+	addrs := make([]sbrdata.Addr, 0, len(s.participants)+1)
+	if outgoing {
+		addrs = append(addrs, sbrdata.Addr{Address: mmsOwnAddress, Type: mmsAddrFrom, Charset: charsetUTF8})
+	} else {
+		addrs = append(addrs, sbrdata.Addr{Address: sender, Type: mmsAddrFrom, Charset: charsetUTF8})
+	}
+	for _, p := range s.participants {
+		if !outgoing && p == sender {
+			continue
+		}
+		addrs = append(addrs, sbrdata.Addr{Address: p, Type: mmsAddrTo, Charset: charsetUTF8})
+	}
+	mms.Addrs.Addr = addrs
+}
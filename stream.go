@@ -0,0 +1,541 @@
+package imazingtosbr
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sascha-andres/reuse"
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// ErrInvalidCollection is returned when a collection file cannot be read while streaming
+var ErrInvalidCollection = errors.New("invalid collection file")
+
+// recordSink receives the records of a streaming conversion
+type recordSink interface {
+	writeCall(call sbrdata.Call) error
+	writeSMS(sms sbrdata.SMS) error
+	writeMMS(mms sbrdata.MMS) error
+	// endSession is called once all messages of a chat session are written
+	endSession()
+}
+
+// flush hands the records converted so far to the sink of a streaming conversion, so
+// they do not accumulate in the result. Without a sink the records stay in the result.
+func (c *conversion) flush() error {
+	if c.sink == nil {
+		return nil
+	}
+	for _, call := range c.result.Calls.Call {
+		if err := c.sink.writeCall(call); err != nil {
+			return err
+		}
+	}
+	for _, sms := range c.result.Messages.Sms {
+		if err := c.sink.writeSMS(sms); err != nil {
+			return err
+		}
+	}
+	for _, mms := range c.result.Messages.Mms {
+		if err := c.sink.writeMMS(mms); err != nil {
+			return err
+		}
+	}
+	c.streamed += len(c.result.Calls.Call) + len(c.result.Messages.Sms) + len(c.result.Messages.Mms)
+	c.result.Calls.Call = c.result.Calls.Call[:0]
+	c.result.Messages.Sms = c.result.Messages.Sms[:0]
+	c.result.Messages.Mms = c.result.Messages.Mms[:0]
+	return nil
+}
+
+// finishPreviousSession completes and flushes the session of a streaming conversion when
+// the export continues with another session. iMazing lists the messages of a session
+// together, so only the current session has to be kept in memory.
+func (a *Application) finishPreviousSession(conv *conversion, name string) error {
+	if conv.sink == nil || len(conv.sessionOrder) == 0 || conv.sessionOrder[len(conv.sessionOrder)-1] == name {
+		return nil
+	}
+	a.finishSessions(conv, conv.sessionOrder)
+	if err := conv.flush(); err != nil {
+		return err
+	}
+	conv.sink.endSession()
+	conv.sessions = nil
+	conv.sessionOrder = nil
+	return nil
+}
+
+// spool collects the JSON encoded elements of an array in a temporary file
+type spool struct {
+	f *os.File
+	w *bufio.Writer
+	// n is the number of elements written
+	n int
+}
+
+// newSpool creates a spool backed by a temporary file
+func newSpool() (*spool, error) {
+	f, err := os.CreateTemp("", "iphone2sbr-*.json")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// write adds an element, indented as an element of an array of the collection
+func (s *spool) write(v any) error {
+	data, err := json.MarshalIndent(v, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	separator := ",\n    "
+	if s.n == 0 {
+		separator = "\n    "
+	}
+	if _, err := s.w.WriteString(separator); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+// copyTo writes the array of all elements to w
+func (s *spool) copyTo(w io.Writer) error {
+	if s.n == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	if err := s.copyElements(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n  ]")
+	return err
+}
+
+// copyElements writes the elements to w, each on a line of its own preceded by a newline
+func (s *spool) copyElements(w io.Writer) error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, s.f)
+	return err
+}
+
+// remove deletes the temporary file
+func (s *spool) remove() {
+	if s == nil {
+		return
+	}
+	_ = s.f.Close()
+	_ = os.Remove(s.f.Name())
+}
+
+// collectionWriter writes a collection as JSON without keeping its records in memory.
+// The document lists all calls before all SMS and MMS, while a conversion produces them
+// in any order, so the records are spooled to temporary files until the writer is closed.
+//
+// To skip duplicates, a hash of the identity of all records of the collection and of all
+// new calls is kept. The identities of new messages are only kept until their chat session
+// ends, as the address is part of the identity of a message. The identities of the added
+// records needed for tagging are spooled as well.
+type collectionWriter struct {
+	w   io.Writer
+	key string
+	// calls, sms and mms spool the records
+	calls, sms, mms *spool
+	// known holds the hashed identities of the records of the collection and of new calls
+	known map[[sha256.Size]byte]struct{}
+	// session holds the hashed identities of the new messages of the current chat session
+	session map[[sha256.Size]byte]struct{}
+	// stats counts the records added by the conversion
+	stats AppendStats
+	// tags spools the identities of the records added by the conversion, nil unless tagging
+	tags *spool
+}
+
+// newCollectionWriter creates a writer of a collection to w. If tag is set, the identities
+// of the added records are spooled for the tag index.
+func newCollectionWriter(w io.Writer, tag bool) (*collectionWriter, error) {
+	cw := &collectionWriter{
+		w:       w,
+		known:   make(map[[sha256.Size]byte]struct{}),
+		session: make(map[[sha256.Size]byte]struct{}),
+	}
+	spools := []**spool{&cw.calls, &cw.sms, &cw.mms}
+	if tag {
+		spools = append(spools, &cw.tags)
+	}
+	for _, s := range spools {
+		var err error
+		if *s, err = newSpool(); err != nil {
+			cw.discard()
+			return nil, err
+		}
+	}
+	return cw, nil
+}
+
+// writeExisting writes a record already present in the collection
+func (cw *collectionWriter) writeExisting(s *spool, key string, v any) error {
+	cw.known[sha256.Sum256([]byte(key))] = struct{}{}
+	return s.write(v)
+}
+
+// writeNew writes a record of the conversion unless it is already present. The identity
+// is added to known, or to the identities of the current chat session for messages.
+func (cw *collectionWriter) writeNew(s *spool, key string, v any, known map[[sha256.Size]byte]struct{}) error {
+	hash := sha256.Sum256([]byte(key))
+	_, existing := cw.known[hash]
+	_, seen := known[hash]
+	if existing || seen {
+		cw.stats.Duplicates++
+		return nil
+	}
+	known[hash] = struct{}{}
+	cw.stats.Added++
+	if cw.tags != nil {
+		if err := cw.tags.write(key); err != nil {
+			return err
+		}
+	}
+	return s.write(v)
+}
+
+// writeCall implements recordSink
+func (cw *collectionWriter) writeCall(call sbrdata.Call) error {
+	return cw.writeNew(cw.calls, callKey(call), call, cw.known)
+}
+
+// writeSMS implements recordSink
+func (cw *collectionWriter) writeSMS(sms sbrdata.SMS) error {
+	return cw.writeNew(cw.sms, smsKey(sms), sms, cw.session)
+}
+
+// writeMMS implements recordSink
+func (cw *collectionWriter) writeMMS(mms sbrdata.MMS) error {
+	return cw.writeNew(cw.mms, mmsKey(mms), mms, cw.session)
+}
+
+// endSession implements recordSink
+func (cw *collectionWriter) endSession() {
+	clear(cw.session)
+}
+
+// close writes the collection document and removes the temporary files
+func (cw *collectionWriter) close() error {
+	defer cw.discard()
+	key, err := json.Marshal(cw.key)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(cw.w)
+	if _, err := fmt.Fprintf(w, "{\n  \"Key\": %s,\n  \"Calls\": ", key); err != nil {
+		return err
+	}
+	arrays := []struct {
+		name string
+		s    *spool
+	}{{"Sms", cw.sms}, {"Mms", cw.mms}}
+	if err := cw.calls.copyTo(w); err != nil {
+		return err
+	}
+	for _, array := range arrays {
+		if _, err := fmt.Fprintf(w, ",\n  %q: ", array.name); err != nil {
+			return err
+		}
+		if err := array.s.copyTo(w); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "\n}"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// discard removes the temporary files
+func (cw *collectionWriter) discard() {
+	cw.calls.remove()
+	cw.sms.remove()
+	cw.mms.remove()
+	cw.tags.remove()
+}
+
+// readCollection passes the records of a collection document to the writer one at a time
+func readCollection(r io.Reader, cw *collectionWriter) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		field, _ := t.(string)
+		switch {
+		case strings.EqualFold(field, "Key"):
+			var key *string
+			if err := dec.Decode(&key); err != nil {
+				return err
+			}
+			if key != nil {
+				cw.key = *key
+			}
+		case strings.EqualFold(field, "Calls"):
+			err = readArray(dec, func() error {
+				var call sbrdata.Call
+				if err := dec.Decode(&call); err != nil {
+					return err
+				}
+				return cw.writeExisting(cw.calls, callKey(call), call)
+			})
+		case strings.EqualFold(field, "Sms"):
+			err = readArray(dec, func() error {
+				var sms sbrdata.SMS
+				if err := dec.Decode(&sms); err != nil {
+					return err
+				}
+				return cw.writeExisting(cw.sms, smsKey(sms), sms)
+			})
+		case strings.EqualFold(field, "Mms"):
+			err = readArray(dec, func() error {
+				var mms sbrdata.MMS
+				if err := dec.Decode(&mms); err != nil {
+					return err
+				}
+				return cw.writeExisting(cw.mms, mmsKey(mms), mms)
+			})
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// readArray calls element for each element of the JSON array read next, null is read as an empty array
+func readArray(dec *json.Decoder, element func() error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("%w: expected array, got %v", ErrInvalidCollection, t)
+	}
+	for dec.More() {
+		if err := element(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token, which has to be the delimiter
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("%w: expected %v, got %v", ErrInvalidCollection, delim, t)
+	}
+	return nil
+}
+
+// writeExistingCollection writes the records of the collection to the writer, streamed
+// from the collection file unless the collection is already in memory
+func (a *Application) writeExistingCollection(cw *collectionWriter) error {
+	if a.collection != nil {
+		cw.key = a.collection.Key
+		for _, c := range a.collection.Calls {
+			if err := cw.writeExisting(cw.calls, callKey(c), c); err != nil {
+				return err
+			}
+		}
+		for _, s := range a.collection.Sms {
+			if err := cw.writeExisting(cw.sms, smsKey(s), s); err != nil {
+				return err
+			}
+		}
+		for _, m := range a.collection.Mms {
+			if err := cw.writeExisting(cw.mms, mmsKey(m), m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if a.collectionFile == "" || !reuse.FileExists(a.collectionFile) {
+		return nil
+	}
+	f, err := os.Open(a.collectionFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return readCollection(f, cw)
+}
+
+// StreamReader converts the export read from r and writes the collection with the new
+// records appended to w, skipping records already present like AppendResult.
+//
+// Records are written as soon as they are complete instead of being collected in the
+// result, so the Calls and Messages of the result stay empty. Memory use consists of the
+// largest chat session of the export plus a hash of 32 bytes for each record of the
+// collection and each new call, which are needed to skip duplicates; the records
+// themselves are never held in memory. A chat session that is not listed in one piece is
+// processed as separate sessions, replies and reactions are only resolved within each part.
+//
+// With a tag, the identities of the added records are added to the tag index in memory,
+// see StreamImport for a tagged import that does not keep them in memory.
+func (a *Application) StreamReader(ctx context.Context, r io.Reader, w io.Writer) (*ConversionResult, AppendStats, error) {
+	var result *ConversionResult
+	stats, keys, err := a.streamTo(w, func(cw *collectionWriter) error {
+		var err error
+		result, err = a.convert(ctx, r, a.attachments, cw)
+		return err
+	})
+	defer keys.remove()
+	if err != nil {
+		return nil, AppendStats{}, err
+	}
+	if err := a.tagSpooledRecords(keys); err != nil {
+		return nil, AppendStats{}, err
+	}
+	return result, stats, nil
+}
+
+// streamTo writes the collection to w, with the records of convert appended to the
+// records already present. If a tag is set, the identities of the added records are
+// returned spooled to a temporary file, which the caller removes.
+func (a *Application) streamTo(w io.Writer, convert func(cw *collectionWriter) error) (AppendStats, *spool, error) {
+	cw, err := newCollectionWriter(w, a.tag != "")
+	if err != nil {
+		return AppendStats{}, nil, err
+	}
+	defer cw.discard()
+	if err := a.writeExistingCollection(cw); err != nil {
+		return AppendStats{}, nil, err
+	}
+	if err := convert(cw); err != nil {
+		return AppendStats{}, nil, err
+	}
+	keys := cw.tags
+	cw.tags = nil
+	if err := cw.close(); err != nil {
+		keys.remove()
+		return AppendStats{}, nil, err
+	}
+	a.l.Debug("streamed records", "added", cw.stats.Added, "duplicates", cw.stats.Duplicates, "tag", a.tag)
+	return cw.stats, keys, nil
+}
+
+// StreamImport converts the import file and appends its records to the collection file
+// like Convert followed by AppendResult, but streams the records as described for
+// StreamReader. The collection is written to a temporary file that replaces the
+// collection file once complete, keeping the backups set with WithBackups. Without a
+// collection file the collection is written to w. With a tag, the identities of the added
+// records are spooled to a temporary file and appended to the tag index file without
+// loading it.
+func (a *Application) StreamImport(w io.Writer) (*ConversionResult, AppendStats, error) {
+	results, err := a.StreamImportFiles(w, a.fileToImport)
+	if err != nil {
+		return nil, AppendStats{}, err
+	}
+	if len(results) == 1 {
+		return results[0].Result, results[0].Stats, nil
+	}
+	// the exports of a ZIP archive are reported as one result like by Convert
+	var stats AppendStats
+	merged := make([]*ConversionResult, 0, len(results))
+	for _, r := range results {
+		merged = append(merged, r.Result)
+		stats.Added += r.Stats.Added
+		stats.Duplicates += r.Stats.Duplicates
+	}
+	return mergeResults(merged), stats, nil
+}
+
+// StreamImportFiles converts the files and appends their records to the collection file
+// like StreamImport, writing the collection once after all files. The import stops at the
+// first file that cannot be converted, leaving the collection file unchanged.
+func (a *Application) StreamImportFiles(w io.Writer, files ...string) ([]FileResult, error) {
+	results := make([]FileResult, 0, len(files))
+	streamFiles := func(cw *collectionWriter) error {
+		for _, file := range files {
+			if err := a.streamFile(cw, file, &results); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if a.collectionFile == "" {
+		_, keys, err := a.streamTo(w, streamFiles)
+		defer keys.remove()
+		if err != nil {
+			return results, err
+		}
+		return results, a.tagSpooledRecords(keys)
+	}
+	var keys *spool
+	err := writeFile(a.collectionFile, a.backups, func(out io.Writer) error {
+		var err error
+		_, keys, err = a.streamTo(out, streamFiles)
+		return err
+	})
+	defer keys.remove()
+	if err != nil {
+		return results, err
+	}
+	return results, a.appendTagIndex(keys)
+}
+
+// streamFile streams the records of all exports of the file to cw and adds a result per export
+func (a *Application) streamFile(cw *collectionWriter, file string, results *[]FileResult) error {
+	sources, closeSources, err := a.importSources(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	defer func() {
+		if err := closeSources(); err != nil {
+			a.l.Error("error closing file", "err", err)
+		}
+	}()
+
+	for _, src := range sources {
+		before := cw.stats
+		result, err := a.convertSource(src, cw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src.name, err)
+		}
+		cw.endSession()
+		*results = append(*results, newFileResult(src.name, result, AppendStats{
+			Added:      cw.stats.Added - before.Added,
+			Duplicates: cw.stats.Duplicates - before.Duplicates,
+		}))
+	}
+	return nil
+}
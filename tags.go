@@ -0,0 +1,274 @@
+package imazingtosbr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/sascha-andres/reuse"
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// ErrNoTag is returned when a tag operation is requested without a tag
+var ErrNoTag = errors.New("no tag given")
+
+// tagIndex maps tags to the identities of the records imported with the tag.
+//
+// SBR has no field to carry arbitrary data, so the index is kept next to the
+// collection file instead of in the records themselves.
+type tagIndex map[string][]string
+
+// tagIndexFile returns the path of the tag index for a collection file
+func tagIndexFile(collectionFile string) string {
+	return collectionFile + ".tags"
+}
+
+// tagIndex returns the tag index, loading it from disk on first use
+func (a *Application) tagIndex() (tagIndex, error) {
+	if a.tags != nil {
+		return a.tags, nil
+	}
+	index := make(tagIndex)
+	if a.collectionFile != "" && reuse.FileExists(tagIndexFile(a.collectionFile)) {
+		data, err := os.ReadFile(tagIndexFile(a.collectionFile))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, err
+		}
+	}
+	a.tags = index
+	return index, nil
+}
+
+// saveTagIndex writes the tag index next to the collection file, if one is set
+func (a *Application) saveTagIndex() error {
+	if a.collectionFile == "" || a.tags == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(tagIndexFile(a.collectionFile), 0, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// tagRecords adds record identities to the configured tag
+func (a *Application) tagRecords(keys []string) error {
+	if a.tag == "" || len(keys) == 0 {
+		return nil
+	}
+	index, err := a.tagIndex()
+	if err != nil {
+		return err
+	}
+	index[a.tag] = append(index[a.tag], keys...)
+	return nil
+}
+
+// tagSpooledRecords adds the record identities spooled in keys to the configured tag
+func (a *Application) tagSpooledRecords(keys *spool) error {
+	if keys == nil || keys.n == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := keys.copyTo(&buf); err != nil {
+		return err
+	}
+	var added []string
+	if err := json.Unmarshal(buf.Bytes(), &added); err != nil {
+		return err
+	}
+	return a.tagRecords(added)
+}
+
+// appendTagIndex adds the record identities spooled in keys to the configured tag and
+// saves the tag index. Unless the index is already loaded, the index file is rewritten
+// one identity at a time, so neither the index nor the new identities are held in memory.
+func (a *Application) appendTagIndex(keys *spool) error {
+	if keys == nil || keys.n == 0 {
+		return nil
+	}
+	if a.tags != nil {
+		if err := a.tagSpooledRecords(keys); err != nil {
+			return err
+		}
+		return a.saveTagIndex()
+	}
+	name := tagIndexFile(a.collectionFile)
+	var existing io.Reader = strings.NewReader("{}")
+	if reuse.FileExists(name) {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		existing = f
+	}
+	return writeFile(name, 0, func(w io.Writer) error {
+		return mergeTagIndex(existing, w, a.tag, keys)
+	})
+}
+
+// mergeTagIndex copies the tag index read from r to w, appending the spooled identities
+// to the tag. The output is formatted like saveTagIndex, tags sorted by name.
+func mergeTagIndex(r io.Reader, w io.Writer, tag string, keys *spool) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	tags := 0
+	// startTag writes the name of a tag followed by the opening bracket of its identities
+	startTag := func(name string) error {
+		data, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		separator := ",\n  "
+		if tags == 0 {
+			separator = "{\n  "
+		}
+		tags++
+		_, err = fmt.Fprintf(bw, "%s%s: [", separator, data)
+		return err
+	}
+	// endTag appends the spooled identities if requested and closes the list
+	endTag := func(n int, appendKeys bool) error {
+		if appendKeys {
+			if n > 0 {
+				if err := bw.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			if err := keys.copyElements(bw); err != nil {
+				return err
+			}
+			n += keys.n
+		}
+		if n == 0 {
+			return bw.WriteByte(']')
+		}
+		_, err := bw.WriteString("\n  ]")
+		return err
+	}
+
+	merged := false
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := t.(string)
+		if !merged && name > tag {
+			if err := startTag(tag); err != nil {
+				return err
+			}
+			if err := endTag(0, true); err != nil {
+				return err
+			}
+			merged = true
+		}
+		if err := startTag(name); err != nil {
+			return err
+		}
+		n := 0
+		err = readArray(dec, func() error {
+			var key string
+			if err := dec.Decode(&key); err != nil {
+				return err
+			}
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				if err := bw.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			n++
+			_, err = fmt.Fprintf(bw, "\n    %s", data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := endTag(n, name == tag); err != nil {
+			return err
+		}
+		merged = merged || name == tag
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	if !merged {
+		if err := startTag(tag); err != nil {
+			return err
+		}
+		if err := endTag(0, true); err != nil {
+			return err
+		}
+	}
+	if _, err := bw.WriteString("\n}"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Tags returns the tags of the collection along with the number of records carrying them
+func (a *Application) Tags() (map[string]int, error) {
+	index, err := a.tagIndex()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int, len(index))
+	for tag, keys := range index {
+		result[tag] = len(keys)
+	}
+	return result, nil
+}
+
+// RemoveTag removes all records carrying the tag from the collection and returns
+// the number of removed records
+func (a *Application) RemoveTag(tag string) (int, error) {
+	if tag == "" {
+		return 0, ErrNoTag
+	}
+	index, err := a.tagIndex()
+	if err != nil {
+		return 0, err
+	}
+	if len(index[tag]) == 0 {
+		// nothing to remove, the collection is not written so backups are kept
+		return 0, nil
+	}
+	collection, err := a.Collection()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make(map[string]bool, len(index[tag]))
+	for _, k := range index[tag] {
+		keys[k] = true
+	}
+	before := len(collection.Calls) + len(collection.Sms) + len(collection.Mms)
+	collection.Calls = slices.DeleteFunc(collection.Calls, func(c sbrdata.Call) bool { return keys[callKey(c)] })
+	collection.Sms = slices.DeleteFunc(collection.Sms, func(s sbrdata.SMS) bool { return keys[smsKey(s)] })
+	collection.Mms = slices.DeleteFunc(collection.Mms, func(m sbrdata.MMS) bool { return keys[mmsKey(m)] })
+	removed := before - len(collection.Calls) - len(collection.Sms) - len(collection.Mms)
+	delete(index, tag)
+
+	a.l.Debug("removed tag", "tag", tag, "removed", removed)
+	return removed, a.saveCollection()
+}
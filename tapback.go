@@ -0,0 +1,326 @@
+package imazingtosbr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sascha-andres/sbrdata/v2"
+)
+
+// ErrUnknownTapbackPolicy is returned when a tapback policy is requested that is not supported
+var ErrUnknownTapbackPolicy = errors.New("unknown tapback policy")
+
+// TapbackPolicy determines how reactions (tapbacks) to iMessages are imported
+type TapbackPolicy uint
+
+const (
+	// TapbackKeep imports reactions as ordinary messages
+	TapbackKeep TapbackPolicy = iota
+	// TapbackDrop skips reactions
+	TapbackDrop
+	// TapbackFold adds reactions as an annotation to the message they react to
+	TapbackFold
+)
+
+// String returns the name of the policy
+func (p TapbackPolicy) String() string {
+	switch p {
+	case TapbackDrop:
+		return "drop"
+	case TapbackFold:
+		return "fold"
+	default:
+		return "keep"
+	}
+}
+
+// ParseTapbackPolicy returns the policy with the given name
+func ParseTapbackPolicy(name string) (TapbackPolicy, error) {
+	for _, p := range []TapbackPolicy{TapbackKeep, TapbackDrop, TapbackFold} {
+		if strings.EqualFold(p.String(), strings.TrimSpace(name)) {
+			return p, nil
+		}
+	}
+	return TapbackKeep, fmt.Errorf("%w: %q", ErrUnknownTapbackPolicy, name)
+}
+
+// TapbackStats counts the reactions found in a message export by how they were handled
+type TapbackStats struct {
+	// Kept is the number of reactions imported as messages, including reactions
+	// that could not be folded because the message reacted to is not part of the export
+	Kept int
+	// Dropped is the number of reactions that were skipped
+	Dropped int
+	// Folded is the number of reactions added to the message they react to
+	Folded int
+}
+
+// tapback describes a reaction pattern, the reaction and the object reacted to are the submatches
+type tapback struct {
+	re *regexp.Regexp
+	// prefix is the literal text every match starts with, checked before running re
+	prefix   string
+	reaction string
+	// attachment is set if the reaction refers to an attachment instead of a quoted text
+	attachment bool
+	// removed is set if the message reports the removal of a reaction
+	removed bool
+}
+
+// reaction is a reaction found in a message export
+type reaction struct {
+	// name of the reaction, e.g. "Liked" or an emoji
+	name string
+	// quoted is the text of the message reacted to, the kind of attachment for attachments
+	quoted string
+	// attachment is set if the reaction refers to an attachment
+	attachment bool
+	// removed is set if the reaction was removed
+	removed bool
+}
+
+// tapbackPattern is a reaction message of a locale consisting of prefix, object and suffix.
+// If reaction is empty, the first submatch of the prefix is the reaction.
+type tapbackPattern struct {
+	prefix, suffix, reaction string
+}
+
+const (
+	quoteOpen  = `[“"„«‘']\s?`
+	quoteClose = `\s?[”"“»’']`
+)
+
+// attachment objects of reactions to attachments like "Loved an image", by locale
+const (
+	attachmentsEn = `an? (?:image|photo|picture|movie|video|attachment|audio message|sticker|file|location)`
+	attachmentsDe = `(?:ein|eine|einen) (?:Bild|Foto|Film|Video|Anhang|Audionachricht|Sticker|Datei|Standort)`
+	attachmentsFr = `(?:une?|la|le|l[’']) ?(?:image|photo|film|vidéo|pièce jointe|message audio|autocollant|fichier|position)`
+	attachmentsEs = `(?:una?|el|la) (?:imagen|foto|película|vídeo|video|archivo adjunto|mensaje de audio|sticker|archivo|ubicación)`
+)
+
+// tapbacks lists the reaction messages of all supported locales
+var tapbacks = slices.Concat(
+	localeTapbacks(attachmentsEn, false,
+		tapbackPattern{`Loved `, ``, "Loved"},
+		tapbackPattern{`Liked `, ``, "Liked"},
+		tapbackPattern{`Disliked `, ``, "Disliked"},
+		tapbackPattern{`Laughed at `, ``, "Laughed at"},
+		tapbackPattern{`Emphasized `, ``, "Emphasized"},
+		tapbackPattern{`Emphasised `, ``, "Emphasized"},
+		tapbackPattern{`Questioned `, ``, "Questioned"},
+		tapbackPattern{`Reacted (\S+) to `, ``, ""},
+	),
+	localeTapbacks(attachmentsEn, true,
+		tapbackPattern{`Removed a heart from `, ``, "Loved"},
+		tapbackPattern{`Removed a like from `, ``, "Liked"},
+		tapbackPattern{`Removed a dislike from `, ``, "Disliked"},
+		tapbackPattern{`Removed a laugh from `, ``, "Laughed at"},
+		tapbackPattern{`Removed an exclamation(?: mark)? from `, ``, "Emphasized"},
+		tapbackPattern{`Removed a question mark from `, ``, "Questioned"},
+		tapbackPattern{`Removed (?:an? )?(\S+) from `, ``, ""},
+	),
+	localeTapbacks(attachmentsDe, false,
+		tapbackPattern{`Hat `, ` geliebt`, "Loved"},
+		tapbackPattern{`Gefällt `, ` nicht`, "Disliked"},
+		tapbackPattern{`Gefällt `, ``, "Liked"},
+		tapbackPattern{`Hat über `, ` gelacht`, "Laughed at"},
+		tapbackPattern{`Hat `, ` hervorgehoben`, "Emphasized"},
+		tapbackPattern{`Hat `, ` infrage gestellt`, "Questioned"},
+		tapbackPattern{`Hat mit (\S+) auf `, ` reagiert`, ""},
+	),
+	localeTapbacks(attachmentsDe, true,
+		tapbackPattern{`Hat ein Herz von `, ` entfernt`, "Loved"},
+		tapbackPattern{`Hat ein „Gefällt mir“ von `, ` entfernt`, "Liked"},
+		tapbackPattern{`Hat ein „Gefällt mir nicht“ von `, ` entfernt`, "Disliked"},
+		tapbackPattern{`Hat ein Lachen von `, ` entfernt`, "Laughed at"},
+		tapbackPattern{`Hat ein Ausrufezeichen von `, ` entfernt`, "Emphasized"},
+		tapbackPattern{`Hat ein Fragezeichen von `, ` entfernt`, "Questioned"},
+	),
+	localeTapbacks(attachmentsFr, false,
+		tapbackPattern{`A adoré `, ``, "Loved"},
+		tapbackPattern{`A aimé `, ``, "Liked"},
+		tapbackPattern{`N[’']a pas aimé `, ``, "Disliked"},
+		tapbackPattern{`A ri de `, ``, "Laughed at"},
+		tapbackPattern{`A mis en évidence `, ``, "Emphasized"},
+		tapbackPattern{`A mis en doute `, ``, "Questioned"},
+		tapbackPattern{`A réagi avec (\S+) à `, ``, ""},
+	),
+	localeTapbacks(attachmentsFr, true,
+		tapbackPattern{`A retiré un cœur de `, ``, "Loved"},
+		tapbackPattern{`A retiré un j[’']aime de `, ``, "Liked"},
+		tapbackPattern{`A retiré un je n[’']aime pas de `, ``, "Disliked"},
+		tapbackPattern{`A retiré un rire de `, ``, "Laughed at"},
+		tapbackPattern{`A retiré un point d[’']exclamation de `, ``, "Emphasized"},
+		tapbackPattern{`A retiré un point d[’']interrogation de `, ``, "Questioned"},
+	),
+	localeTapbacks(attachmentsEs, false,
+		tapbackPattern{`Le encanta `, ``, "Loved"},
+		tapbackPattern{`Le gusta `, ``, "Liked"},
+		tapbackPattern{`No le gusta `, ``, "Disliked"},
+		tapbackPattern{`Se rió de `, ``, "Laughed at"},
+		tapbackPattern{`Enfatizó `, ``, "Emphasized"},
+		tapbackPattern{`Cuestionó `, ``, "Questioned"},
+		tapbackPattern{`Reaccionó con (\S+) a `, ``, ""},
+	),
+	localeTapbacks(attachmentsEs, true,
+		tapbackPattern{`Eliminó un corazón de `, ``, "Loved"},
+		tapbackPattern{`Eliminó un me gusta de `, ``, "Liked"},
+		tapbackPattern{`Eliminó un no me gusta de `, ``, "Disliked"},
+		tapbackPattern{`Eliminó una risa de `, ``, "Laughed at"},
+		tapbackPattern{`Eliminó un signo de exclamación de `, ``, "Emphasized"},
+		tapbackPattern{`Eliminó un signo de interrogación de `, ``, "Questioned"},
+	),
+)
+
+// localeTapbacks creates the reaction patterns of a locale, each pattern matches a reaction
+// to a quoted text and a reaction to one of the attachments
+func localeTapbacks(attachments string, removed bool, patterns ...tapbackPattern) []tapback {
+	result := make([]tapback, 0, 2*len(patterns))
+	for _, p := range patterns {
+		result = append(result,
+			newTapback(p.prefix+quoteOpen+`(.*?)`+quoteClose+p.suffix, p.reaction, false, removed),
+			newTapback(p.prefix+`(`+attachments+`)`+p.suffix, p.reaction, true, removed))
+	}
+	return result
+}
+
+// newTapback creates a reaction pattern matching the whole message
+func newTapback(pattern, reaction string, attachment, removed bool) tapback {
+	return tapback{
+		re:         regexp.MustCompile(`^` + pattern + `$`),
+		prefix:     literalPrefix(pattern),
+		reaction:   reaction,
+		attachment: attachment,
+		removed:    removed,
+	}
+}
+
+// literalPrefix returns the text of a pattern up to its first special character
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `\.+*?()|[]{}^$`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// parseTapback returns the reaction if the body is a reaction. Every message of an
+// export is checked, so the patterns are only run on bodies starting with their prefix.
+func parseTapback(body string) (reaction, bool) {
+	body = strings.TrimSpace(body)
+	for _, t := range tapbacks {
+		if !strings.HasPrefix(body, t.prefix) {
+			continue
+		}
+		m := t.re.FindStringSubmatch(body)
+		if m == nil {
+			continue
+		}
+		r := reaction{name: t.reaction, attachment: t.attachment, removed: t.removed}
+		if t.reaction == "" {
+			r.name, m = m[1], m[1:]
+		}
+		r.quoted = m[1]
+		return r, true
+	}
+	return reaction{}, false
+}
+
+// handleTapback applies the tapback policy to a message. It returns true if the message
+// is a reaction that must not be imported as a message.
+//
+// When folding, a reaction to an attachment is added to the most recent message with an
+// attachment, and a removed reaction removes the annotation of the reaction again. A
+// removed reaction without annotation is dropped.
+func (a *Application) handleTapback(conv *conversion, s *chatSession, body, sender string) bool {
+	r, ok := parseTapback(body)
+	if !ok {
+		return false
+	}
+	stats := &conv.result.Tapbacks
+	switch a.tapbackPolicy {
+	case TapbackDrop:
+		stats.Dropped++
+		return true
+	case TapbackFold:
+		target, found := s.findMessage(r.quoted)
+		if r.attachment {
+			target, found = s.findAttachment()
+		}
+		if !found {
+			conv.warn("message reacted to (%q) not found in chat session %q, importing reaction as message", r.quoted, s.name)
+			stats.Kept++
+			return false
+		}
+		annotation := fmt.Sprintf("[%s by %s]", r.name, sender)
+		if !r.removed {
+			a.annotate(conv, target, annotation)
+			stats.Folded++
+			return true
+		}
+		if a.removeAnnotation(conv, target, annotation) {
+			stats.Folded++
+		} else {
+			stats.Dropped++
+		}
+		return true
+	default:
+		stats.Kept++
+		return false
+	}
+}
+
+// annotate appends an annotation to the text of a message already converted. A MMS
+// without text, e.g. a photo, gets a text part holding the annotation.
+func (a *Application) annotate(conv *conversion, m sessionMessage, annotation string) {
+	messageData := conv.result.Messages
+	if m.sms >= 0 {
+		messageData.Sms[m.sms].Body += "\n" + annotation
+		return
+	}
+	mms := &messageData.Mms[m.mms]
+	for i := range mms.Parts.Part {
+		if mms.Parts.Part[i].Ct == "text/plain" {
+			mms.Parts.Part[i].AttrText += "\n" + annotation
+			return
+		}
+	}
+	mms.Parts.Part = append(mms.Parts.Part, sbrdata.Part{
+		Seq:      strconv.Itoa(len(mms.Parts.Part)),
+		Ct:       "text/plain",
+		Name:     "text.txt",
+		Chset:    charsetUTF8,
+		Cl:       "text.txt",
+		AttrText: annotation,
+	})
+}
+
+// removeAnnotation removes the most recent occurrence of an annotation from the text of
+// a message already converted, it returns false if the message has no such annotation
+func (a *Application) removeAnnotation(conv *conversion, m sessionMessage, annotation string) bool {
+	messageData := conv.result.Messages
+	texts := make([]*string, 0, 1)
+	if m.sms >= 0 {
+		texts = append(texts, &messageData.Sms[m.sms].Body)
+	} else {
+		parts := messageData.Mms[m.mms].Parts.Part
+		for i := range parts {
+			if parts[i].Ct == "text/plain" {
+				texts = append(texts, &parts[i].AttrText)
+			}
+		}
+	}
+	for _, text := range texts {
+		lines := strings.Split(*text, "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			if lines[i] == annotation {
+				*text = strings.Join(slices.Delete(lines, i, i+1), "\n")
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package imazingtosbr
+
+import (
+	"time"
+)
+
+// wallClockResolution describes how a wall clock time was mapped to an instant
+type wallClockResolution uint
+
+const (
+	// wallClockUnique is a wall clock time that occurs exactly once
+	wallClockUnique wallClockResolution = iota
+	// wallClockAmbiguous is a wall clock time that occurs twice (DST ends); the earlier instant is used
+	wallClockAmbiguous
+	// wallClockNonexistent is a wall clock time skipped by a DST start; the offset in effect
+	// before the transition is used, which moves the time forward by the size of the gap
+	wallClockNonexistent
+)
+
+// String returns the name of the resolution used for logging
+func (r wallClockResolution) String() string {
+	switch r {
+	case wallClockAmbiguous:
+		return "ambiguous"
+	case wallClockNonexistent:
+		return "nonexistent"
+	default:
+		return "unique"
+	}
+}
+
+// resolveWallClock interprets the wall clock of t (ignoring its location) in loc.
+//
+// time.Date does not guarantee which offset is used around DST transitions, so both
+// offsets in effect around the wall clock time are tried explicitly:
+//   - ambiguous times (DST ends, the hour repeats) resolve to the earlier instant
+//   - nonexistent times (DST starts, the hour is skipped) use the offset before the transition
+func resolveWallClock(t time.Time, loc *time.Location) (time.Time, wallClockResolution) {
+	naive := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+
+	// offsets never change twice within a day, so the offsets a day before and after
+	// are the only candidates for the wall clock time
+	_, offsetBefore := naive.Add(-24 * time.Hour).In(loc).Zone()
+	_, offsetAfter := naive.Add(24 * time.Hour).In(loc).Zone()
+
+	candidateBefore := naive.Add(-time.Duration(offsetBefore) * time.Second)
+	candidateAfter := naive.Add(-time.Duration(offsetAfter) * time.Second)
+	validBefore := sameWallClock(candidateBefore.In(loc), naive)
+	validAfter := sameWallClock(candidateAfter.In(loc), naive)
+
+	switch {
+	case validBefore && validAfter && !candidateBefore.Equal(candidateAfter):
+		if candidateAfter.Before(candidateBefore) {
+			return candidateAfter.In(loc), wallClockAmbiguous
+		}
+		return candidateBefore.In(loc), wallClockAmbiguous
+	case validBefore:
+		return candidateBefore.In(loc), wallClockUnique
+	case validAfter:
+		return candidateAfter.In(loc), wallClockUnique
+	default:
+		return candidateBefore.In(loc), wallClockNonexistent
+	}
+}
+
+// sameWallClock returns true if both times show the same wall clock
+func sameWallClock(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd &&
+		a.Hour() == b.Hour() && a.Minute() == b.Minute() && a.Second() == b.Second() && a.Nanosecond() == b.Nanosecond()
+}
+
+// localTime converts a wall clock time read from the export to an instant in the
+// timezone of the exporting device
+func (c *conversion) localTime(t time.Time) time.Time {
+	result, resolution := resolveWallClock(t, c.timezone)
+	if resolution != wallClockUnique {
+		c.warn("%s wall clock time %s in %s resolved to %s", resolution, t.Format(readableDateLayout), c.timezone, result.Format(time.RFC3339))
+	}
+	return result
+}
@@ -1,10 +1,15 @@
 package imazingtosbr
 
 import (
+	"context"
 	"encoding/csv"
 	"errors"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/sascha-andres/reuse"
@@ -15,41 +20,93 @@ var (
 	// ErrImportFileDoesNotExist is returned when the import file does not exist
 	ErrImportFileDoesNotExist = errors.New("import file does not exist")
 
-	// headerIndexMapCall maps the header names to their index in the CSV file for calls
-	headerIndexMapCall = map[string]int{
-		"Call Type": 0,
-		"Date":      1,
-		"Duration":  2,
-		"Number":    3,
-		"Contact":   4,
-		"Location":  5,
-		"Service":   6,
-	}
-
-	// headerIndexMapMessages maps the header names to their index in the CSV file for messages
-	headerIndexMapMessages = map[string]int{
-		"Chat Session":    0,
-		"Message Date":    1,
-		"Delivered Date":  2,
-		"Read Date":       3,
-		"Edited Date":     4,
-		"Service":         5,
-		"Type":            6,
-		"Sender ID":       7,
-		"Sender Name":     8,
-		"Status":          9,
-		"Replying to":     10,
-		"Subject":         11,
-		"Text":            12,
-		"Attachment":      13,
-		"Attachment type": 14,
+	// ErrInvalidTimezone is returned when no timezone is provided
+	ErrInvalidTimezone = errors.New("invalid timezone")
+
+	// ErrUnsupportedFileFormat is returned when the header row does not belong to a known export
+	ErrUnsupportedFileFormat = errors.New("unsupported file format")
+
+	// callTypes maps the canonical iMazing call types to SBR call types
+	callTypes = map[string]string{
+		callTypeIncoming:  sbrCallTypeIncoming,
+		callTypeOutgoing:  sbrCallTypeOutgoing,
+		callTypeMissed:    sbrCallTypeMissed,
+		callTypeVoicemail: sbrCallTypeVoicemail,
+		callTypeRejected:  sbrCallTypeRejected,
+		callTypeDeclined:  sbrCallTypeRejected,
+		callTypeBlocked:   sbrCallTypeBlocked,
+		// a cancelled call is an outgoing call that was not answered
+		callTypeCancelled: sbrCallTypeOutgoing,
+		callTypeCanceled:  sbrCallTypeOutgoing,
+	}
+
+	// presentations maps the canonical placeholders iMazing uses instead of a number to SBR presentations
+	presentations = map[string]string{
+		"No Caller ID":   sbrPresentationRestricted,
+		"Private Number": sbrPresentationRestricted,
+		"Withheld":       sbrPresentationRestricted,
+		"Anonymous":      sbrPresentationRestricted,
+		"Unknown":        sbrPresentationUnknown,
+		"Payphone":       sbrPresentationPayphone,
+		"Pay Phone":      sbrPresentationPayphone,
+	}
+
+	// callColumns lists the columns of an iMazing call history export
+	callColumns = []column{
+		{name: "Call type", required: true},
+		{name: "Date", required: true},
+		{name: "Duration", required: true},
+		{name: "Number", required: true},
+		{name: "Contact"},
+		{name: "Location"},
+		{name: "Service"},
+	}
+
+	// messageColumns lists the columns of an iMazing message export
+	messageColumns = []column{
+		{name: "Chat Session", required: true},
+		{name: "Message Date", required: true},
+		{name: "Delivered Date"},
+		{name: "Read Date"},
+		{name: "Edited Date"},
+		{name: "Service"},
+		{name: "Type", required: true},
+		{name: "Sender ID"},
+		{name: "Sender Name"},
+		{name: "Status"},
+		{name: "Replying to"},
+		{name: "Subject"},
+		{name: "Text", required: true},
+		{name: "Attachment"},
+		{name: "Attachment type"},
 	}
 )
 
 const (
-	phonePrefix      = "Phone: "
-	callTypeOutgoing = "Outgoing"
-	callTypeIncoming = "Incoming"
+	phonePrefix       = "Phone: "
+	callTypeOutgoing  = "Outgoing"
+	callTypeIncoming  = "Incoming"
+	callTypeMissed    = "Missed"
+	callTypeVoicemail = "Voicemail"
+	callTypeRejected  = "Rejected"
+	callTypeDeclined  = "Declined"
+	callTypeBlocked   = "Blocked"
+	callTypeCancelled = "Cancelled"
+	callTypeCanceled  = "Canceled"
+	// SBR call types
+	sbrCallTypeIncoming  = "1"
+	sbrCallTypeOutgoing  = "2"
+	sbrCallTypeMissed    = "3"
+	sbrCallTypeVoicemail = "4"
+	sbrCallTypeRejected  = "5"
+	sbrCallTypeBlocked   = "6"
+	// SBR caller ID presentations
+	sbrPresentationAllowed    = "1"
+	sbrPresentationRestricted = "2"
+	sbrPresentationUnknown    = "3"
+	sbrPresentationPayphone   = "4"
+	// readableDateLayout is used for the readable date of all records, regardless of the export locale
+	readableDateLayout = "2006-01-02 15:04:05"
 )
 
 // Application represents the main application component
@@ -60,52 +117,34 @@ type Application struct {
 	fileToImport string
 	// Collection file to append to
 	collectionFile string
-	// Tag to apply to all imported calls
+	// Number of previous versions of the collection file kept as backups
+	backups int
+	// Tag to apply to all imported records
 	tag string
-}
-
-// AppendCalls adds the calls to the collection file
-func (a *Application) AppendCalls(calls *sbrdata.Calls) error {
-	var err error
-	collection := &sbrdata.Collection{
-		Key:   "",
-		Calls: make([]sbrdata.Call, 0),
-		Sms:   make([]sbrdata.SMS, 0),
-		Mms:   make([]sbrdata.MMS, 0),
-	}
-	if reuse.FileExists(a.collectionFile) {
-		collection, err = sbrdata.LoadCollection(a.collectionFile)
-		if err != nil {
-			return err
-		}
-	}
-	err = collection.AddCalls(calls)
-	if err != nil {
-		return err
-	}
-	return collection.Save(a.collectionFile)
-}
-
-// AppendMessages adds the messages to the collection file
-func (a *Application) AppendMessages(messages *sbrdata.Messages) error {
-	var err error
-	collection := &sbrdata.Collection{
-		Key:   "",
-		Calls: make([]sbrdata.Call, 0),
-		Sms:   make([]sbrdata.SMS, 0),
-		Mms:   make([]sbrdata.MMS, 0),
-	}
-	if reuse.FileExists(a.collectionFile) {
-		collection, err = sbrdata.LoadCollection(a.collectionFile)
-		if err != nil {
-			return err
-		}
-	}
-	err = collection.AddMessages(messages)
-	if err != nil {
-		return err
-	}
-	return collection.Save(a.collectionFile)
+	// tags maps tags to the records carrying them, loaded on first use
+	tags tagIndex
+	// Locale of the export, detected from the header row if nil
+	locale *locale
+	// Timezone of the exporting device, used to interpret the timestamps of the export
+	timezone *time.Location
+	// Prepend a quote of the referenced message to replies
+	replyContext bool
+	// How to import reactions to messages
+	tapbackPolicy TapbackPolicy
+	// Skip rows that cannot be converted instead of failing
+	lenient bool
+	// How to import calls, by service
+	callPolicies map[string]CallPolicy
+	// Country calling code used for phone numbers without one, e.g. "49"
+	countryCode string
+	// contacts used to fill in missing contact names
+	contacts []contact
+	// contactNames maps phone numbers and email addresses to contact names, built on first use
+	contactNames contactIndex
+	// Attachment files referenced by messages, defaults to the directory of the import file
+	attachments fs.FS
+	// Collection records are appended to, loaded from the collection file on first use
+	collection *sbrdata.Collection
 }
 
 type FileType uint
@@ -114,47 +153,138 @@ const (
 	UnknownFile FileType = iota
 	CallHistoryFile
 	MessageHistoryFile
+	// MixedFile is the type of a ZIP archive holding call history and message exports,
+	// the result holds both calls and messages
+	MixedFile
 )
 
-// Convert converts the CSV file to SBR data
-func (a *Application) Convert() (any, FileType, error) {
-	start := time.Now()
-	a.l.Debug("converting file", "file", a.fileToImport)
-	defer a.l.Debug("conversion finished", "duration_ms", time.Since(start).Milliseconds())
+// String returns the name of the file type
+func (f FileType) String() string {
+	switch f {
+	case CallHistoryFile:
+		return "call_history"
+	case MessageHistoryFile:
+		return "messages"
+	case MixedFile:
+		return "mixed"
+	default:
+		return "unknown"
+	}
+}
 
-	file, err := os.Open(a.fileToImport)
+// Convert converts the CSV file to SBR data. The import file may be a ZIP archive, all
+// iMazing exports it contains are converted and their attachments resolved in the archive.
+func (a *Application) Convert() (*ConversionResult, error) {
+	sources, closeSources, err := a.importSources(a.fileToImport)
 	if err != nil {
-		return nil, UnknownFile, err
+		return nil, err
 	}
 	defer func() {
-		err := file.Close()
-		if err != nil {
+		if err := closeSources(); err != nil {
 			a.l.Error("error closing file", "err", err)
 		}
 	}()
 
-	csvIn := csv.NewReader(file)
+	if !isZipFile(a.fileToImport) {
+		return a.convertSource(sources[0], nil)
+	}
+	return a.convertArchive(sources)
+}
+
+// ConvertReader converts CSV data read from r to SBR data. Attachments are resolved
+// using the file system set with WithAttachments.
+func (a *Application) ConvertReader(ctx context.Context, r io.Reader) (*ConversionResult, error) {
+	return a.convert(ctx, r, a.attachments, nil)
+}
+
+// importAttachments returns the attachments of an import file, defaulting to its directory
+func (a *Application) importAttachments(file string) fs.FS {
+	if a.attachments != nil {
+		return a.attachments
+	}
+	return os.DirFS(filepath.Dir(file))
+}
+
+// convert converts CSV data read from r, resolving attachments in the given file system
+func (a *Application) convert(ctx context.Context, r io.Reader, attachments fs.FS, sink recordSink) (*ConversionResult, error) {
+	start := time.Now()
+	defer func() {
+		a.l.Debug("conversion finished", "duration_ms", time.Since(start).Milliseconds())
+	}()
+
+	r, format, err := normalizeInput(r)
+	if err != nil {
+		return nil, err
+	}
+	a.l.Debug("detected input format", "encoding", format.encoding, "bom", format.bom, "delimiter", format.delimiterName())
+
+	csvIn := csv.NewReader(r)
+	csvIn.Comma = format.delimiter
 
-	// print header in debug mode in case anything changes
 	header, err := csvIn.Read()
 	if err != nil {
-		return nil, UnknownFile, err
+		return nil, err
 	}
-	for _, h := range header {
-		a.l.Debug("header", "header", h, "map", headerIndexMapCall[h])
+
+	loc := a.locale
+	if loc == nil {
+		loc, header = detectLocale(header)
+	} else {
+		header = loc.canonicalHeader(header)
+	}
+	fileType, columns := detectFileType(header)
+	if fileType == UnknownFile {
+		return nil, ErrUnsupportedFileFormat
+	}
+	a.l.Debug("detected locale", "locale", loc.name)
+	index, unknown, err := newColumnIndex(fileType, header, columns)
+	if err != nil {
+		return nil, err
+	}
+	conv := &conversion{
+		l:           a.l,
+		csvIn:       csvIn,
+		columns:     index,
+		loc:         loc,
+		timezone:    a.timezone,
+		attachments: attachments,
+		result:      newConversionResult(fileType),
+		line:        1,
+		lenient:     a.lenient,
+		sink:        sink,
+	}
+	// print header in debug mode in case anything changes
+	for name, i := range index {
+		a.l.Debug("header", "header", name, "index", i)
+	}
+	for _, h := range unknown {
+		conv.warn("unknown column %q in header, ignoring", h)
 	}
 
 	csvIn.ReuseRecord = true
 
-	if header[0] == "Call type" {
-		// it is a call history file
-		return a.transformCallData(csvIn)
+	if fileType == CallHistoryFile {
+		err = a.transformCallData(ctx, conv)
+	} else {
+		err = a.transformMessageData(ctx, conv)
 	}
-	if header[0] == "Chat Session" {
-		return a.transformMessageData(csvIn)
+	if err != nil {
+		return nil, err
 	}
+	return conv.result, nil
+}
 
-	return nil, UnknownFile, errors.New("unsupported file format")
+// detectFileType identifies the export type from the header row
+func detectFileType(header []string) (FileType, []column) {
+	for _, h := range header {
+		switch normalizeHeader(h) {
+		case normalizeHeader("Call type"):
+			return CallHistoryFile, callColumns
+		case normalizeHeader("Chat Session"):
+			return MessageHistoryFile, messageColumns
+		}
+	}
+	return UnknownFile, nil
 }
 
 // str2Ptr converts a string to a pointer
@@ -171,6 +301,128 @@ func WithCollectionFile(file string) ApplicationOption {
 	}
 }
 
+// WithBackups sets the number of previous versions of the collection file kept when it
+// is written, as collection.json.1 (the most recent) to collection.json.N. Defaults to 0.
+func WithBackups(n int) ApplicationOption {
+	return func(app *Application) error {
+		if n < 0 {
+			return ErrNegativeBackups
+		}
+		app.backups = n
+		return nil
+	}
+}
+
+// WithCollection sets the collection to append to. Without a collection file the
+// collection is only kept in memory, see Collection and AppendTo.
+func WithCollection(collection *sbrdata.Collection) ApplicationOption {
+	return func(app *Application) error {
+		app.collection = collection
+		return nil
+	}
+}
+
+// WithAttachments sets the file system holding the attachment files of a message export
+func WithAttachments(fsys fs.FS) ApplicationOption {
+	return func(app *Application) error {
+		app.attachments = fsys
+		return nil
+	}
+}
+
+// WithAttachmentDir sets the directory holding the attachment files of a message export
+func WithAttachmentDir(dir string) ApplicationOption {
+	return func(app *Application) error {
+		if dir == "" {
+			return nil
+		}
+		app.attachments = os.DirFS(dir)
+		return nil
+	}
+}
+
+// WithReplyContext prepends a quote of the message replied to to the text of replies
+func WithReplyContext(enabled bool) ApplicationOption {
+	return func(app *Application) error {
+		app.replyContext = enabled
+		return nil
+	}
+}
+
+// WithTapbackPolicy sets how reactions to messages are imported, defaults to TapbackKeep
+func WithTapbackPolicy(policy TapbackPolicy) ApplicationOption {
+	return func(app *Application) error {
+		app.tapbackPolicy = policy
+		return nil
+	}
+}
+
+// WithLenient skips rows that cannot be converted instead of failing the conversion,
+// the skipped rows are reported in the SkippedRows of the result
+func WithLenient(enabled bool) ApplicationOption {
+	return func(app *Application) error {
+		app.lenient = enabled
+		return nil
+	}
+}
+
+// WithCallPolicy sets how calls of a service are imported. The policy applies to the
+// service from the "Service" column, e.g. "Teams Audio", or to all variants of a service
+// if it is given without "Audio" or "Video", e.g. "Teams". The service "*" sets the policy
+// of all services without their own policy, defaults to CallImport.
+func WithCallPolicy(service string, policy CallPolicy) ApplicationOption {
+	return func(app *Application) error {
+		if app.callPolicies == nil {
+			app.callPolicies = make(map[string]CallPolicy)
+		}
+		app.callPolicies[strings.TrimSpace(service)] = policy
+		return nil
+	}
+}
+
+// WithCountryCode sets the country calling code (e.g. "49" or "+49") used to normalize
+// national phone numbers to E.164 format
+func WithCountryCode(code string) ApplicationOption {
+	return func(app *Application) error {
+		if code == "" {
+			return nil
+		}
+		cc, err := parseCountryCode(code)
+		if err != nil {
+			return err
+		}
+		app.countryCode = cc
+		return nil
+	}
+}
+
+// WithContacts reads contacts from a vCard file to fill in contact names missing in the export
+func WithContacts(r io.Reader) ApplicationOption {
+	return func(app *Application) error {
+		contacts, err := parseVCards(r)
+		if err != nil {
+			return err
+		}
+		app.contacts = append(app.contacts, contacts...)
+		return nil
+	}
+}
+
+// WithContactsFile reads contacts from a vCard file, see WithContacts
+func WithContactsFile(file string) ApplicationOption {
+	return func(app *Application) error {
+		if file == "" {
+			return nil
+		}
+		contacts, err := readContactsFile(file)
+		if err != nil {
+			return err
+		}
+		app.contacts = append(app.contacts, contacts...)
+		return nil
+	}
+}
+
 // WithCsvFile sets the file to import
 func WithCsvFile(fileToImport string) ApplicationOption {
 	return func(app *Application) error {
@@ -182,7 +434,7 @@ func WithCsvFile(fileToImport string) ApplicationOption {
 	}
 }
 
-// WithTag sets the tag to apply to all imported calls
+// WithTag sets the tag to apply to all imported records, see Tags and RemoveTag
 func WithTag(tag string) ApplicationOption {
 	return func(app *Application) error {
 		app.tag = tag
@@ -190,9 +442,35 @@ func WithTag(tag string) ApplicationOption {
 	}
 }
 
+// WithLocale sets the locale of the export instead of detecting it from the header row
+func WithLocale(name string) ApplicationOption {
+	return func(app *Application) error {
+		if name == "" {
+			return nil
+		}
+		l, err := lookupLocale(name)
+		if err != nil {
+			return err
+		}
+		app.locale = l
+		return nil
+	}
+}
+
+// WithTimezone sets the timezone of the exporting device, defaults to the system timezone
+func WithTimezone(loc *time.Location) ApplicationOption {
+	return func(app *Application) error {
+		if loc == nil {
+			return ErrInvalidTimezone
+		}
+		app.timezone = loc
+		return nil
+	}
+}
+
 // NewApplication creates a new Application
 func NewApplication(l *slog.Logger, opts ...ApplicationOption) (*Application, error) {
-	app := &Application{l: l}
+	app := &Application{l: l, timezone: time.Local}
 	for _, opt := range opts {
 		if err := opt(app); err != nil {
 			return nil, err
@@ -1,14 +1,25 @@
 package imazingtosbr
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf16"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/sascha-andres/sbrdata/v2"
@@ -16,7 +27,14 @@ import (
 )
 
 type Parameters struct {
-	FileType string `json:"file_type"`
+	FileType     string `json:"file_type"`
+	Locale       string `json:"locale"`
+	Timezone     string `json:"timezone"`
+	ReplyContext bool   `json:"reply_context"`
+	Tapbacks     string `json:"tapbacks"`
+	CountryCode  string `json:"country_code"`
+	Contacts     string `json:"contacts"`
+	CallPolicies string `json:"call_policies"`
 }
 
 // TestConvert tests the Convert function using txtar test cases
@@ -38,7 +56,8 @@ func TestConvert(t *testing.T) {
 				t.Fatalf("failed to parse txtar file: %v", err)
 			}
 
-			// Extract input CSV and options
+			// Extract input CSV and options, other files are written next to the CSV
+			tmpDir := t.TempDir()
 			var inputCSV []byte
 			var parameters Parameters
 			var expected string
@@ -53,6 +72,14 @@ func TestConvert(t *testing.T) {
 					}
 				case "result.json":
 					expected = strings.TrimSpace(string(file.Data))
+				default:
+					name := filepath.Join(tmpDir, filepath.FromSlash(file.Name))
+					if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+						t.Fatalf("failed to create directory for %s: %v", file.Name, err)
+					}
+					if err := os.WriteFile(name, file.Data, 0644); err != nil {
+						t.Fatalf("failed to write %s: %v", file.Name, err)
+					}
 				}
 			}
 
@@ -61,7 +88,6 @@ func TestConvert(t *testing.T) {
 			}
 
 			// Create temporary CSV file
-			tmpDir := t.TempDir()
 			csvPath := filepath.Join(tmpDir, "input.csv")
 			if err := os.WriteFile(csvPath, inputCSV, 0644); err != nil {
 				t.Fatalf("failed to write temp CSV: %v", err)
@@ -72,13 +98,43 @@ func TestConvert(t *testing.T) {
 				Level: slog.LevelError, // Suppress logs during tests
 			}))
 
+			// Timestamps are interpreted as UTC unless the test case asks for a timezone
+			timezone := time.UTC
+			if parameters.Timezone != "" {
+				timezone, err = time.LoadLocation(parameters.Timezone)
+				if err != nil {
+					t.Fatalf("failed to load timezone: %v", err)
+				}
+			}
+
+			tapbackPolicy := TapbackKeep
+			if parameters.Tapbacks != "" {
+				tapbackPolicy, err = ParseTapbackPolicy(parameters.Tapbacks)
+				if err != nil {
+					t.Fatalf("failed to parse tapback policy: %v", err)
+				}
+			}
+
+			opts := []ApplicationOption{WithCsvFile(csvPath), WithLocale(parameters.Locale), WithTimezone(timezone),
+				WithReplyContext(parameters.ReplyContext), WithTapbackPolicy(tapbackPolicy), WithCountryCode(parameters.CountryCode)}
+			if parameters.Contacts != "" {
+				opts = append(opts, WithContactsFile(filepath.Join(tmpDir, parameters.Contacts)))
+			}
+			callPolicies, err := ParseCallPolicies(parameters.CallPolicies)
+			if err != nil {
+				t.Fatalf("failed to parse call policies: %v", err)
+			}
+			for service, policy := range callPolicies {
+				opts = append(opts, WithCallPolicy(service, policy))
+			}
+
 			// Create application and run conversion
-			app, err := NewApplication(logger, WithCsvFile(csvPath))
+			app, err := NewApplication(logger, opts...)
 			if err != nil {
 				t.Fatalf("failed to create application: %v", err)
 			}
 
-			result, fileType, err := app.Convert()
+			result, err := app.Convert()
 			if err != nil {
 				t.Fatalf("Convert() error = %v", err)
 			}
@@ -94,27 +150,19 @@ func TestConvert(t *testing.T) {
 			expectedFileType := parameters.FileType
 			switch expectedFileType {
 			case "call_history":
-				if fileType != CallHistoryFile {
-					t.Errorf("expected CallHistoryFile, got %v", fileType)
+				if result.FileType != CallHistoryFile {
+					t.Errorf("expected CallHistoryFile, got %v", result.FileType)
 				}
 				// Verify call data
-				callData, ok := result.(*sbrdata.Calls)
-				if !ok {
-					t.Fatalf("expected *sbrdata.Calls, got %T", result)
-				}
-				if err := collection.AddCalls(callData); err != nil {
+				if err := collection.AddCalls(result.Calls); err != nil {
 					t.Fatalf("failed to add calls to collection: %v", err)
 				}
 			case "messages":
-				if fileType != MessageHistoryFile {
-					t.Errorf("expected MessageHistoryFile, got %v", fileType)
+				if result.FileType != MessageHistoryFile {
+					t.Errorf("expected MessageHistoryFile, got %v", result.FileType)
 				}
 				// Verify message data
-				messageData, ok := result.(*sbrdata.Messages)
-				if !ok {
-					t.Fatalf("expected *sbrdata.Messages, got %T", result)
-				}
-				if err := collection.AddMessages(messageData); err != nil {
+				if err := collection.AddMessages(result.Messages); err != nil {
 					t.Fatalf("failed to add messages to collection: %v", err)
 				}
 			default:
@@ -153,12 +201,9 @@ func TestConvertInvalidFile(t *testing.T) {
 		t.Fatalf("failed to create application: %v", err)
 	}
 
-	_, fileType, err := app.Convert()
-	if err == nil {
-		t.Error("expected error for invalid file format, got nil")
-	}
-	if fileType != UnknownFile {
-		t.Errorf("expected UnknownFile type, got %v", fileType)
+	_, err = app.Convert()
+	if !errors.Is(err, ErrUnsupportedFileFormat) {
+		t.Errorf("expected ErrUnsupportedFileFormat, got %v", err)
 	}
 }
 
@@ -174,15 +219,13 @@ func TestConvertNonExistentFile(t *testing.T) {
 	}
 }
 
-// TestCallTypeMapping tests that call types are correctly mapped
-func TestCallTypeMapping(t *testing.T) {
+// TestConvertMissingColumns tests Convert with a header lacking required columns
+func TestConvertMissingColumns(t *testing.T) {
 	tmpDir := t.TempDir()
-	csvPath := filepath.Join(tmpDir, "test.csv")
-
-	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
-Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890
-Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210`
+	csvPath := filepath.Join(tmpDir, "missing.csv")
 
+	csvData := `Call type,Date,Contact
+Outgoing,2024-01-01 12:00:00,Test Contact`
 	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
 		t.Fatalf("failed to write temp CSV: %v", err)
 	}
@@ -196,107 +239,97 @@ Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +987
 		t.Fatalf("failed to create application: %v", err)
 	}
 
-	result, _, err := app.Convert()
-	if err != nil {
-		t.Fatalf("Convert() error = %v", err)
-	}
-
-	callData := result.(*sbrdata.Calls)
-	if len(callData.Call) != 2 {
-		t.Fatalf("expected 2 calls, got %d", len(callData.Call))
+	_, err = app.Convert()
+	var missingErr *MissingColumnsError
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("expected MissingColumnsError, got %v", err)
 	}
-
-	// First call should be Outgoing (type 2)
-	if callData.Call[0].Type != "2" {
-		t.Errorf("expected outgoing call type '2', got '%s'", callData.Call[0].Type)
+	if missingErr.FileType != CallHistoryFile {
+		t.Errorf("expected CallHistoryFile type, got %v", missingErr.FileType)
 	}
-
-	// Second call should be Incoming (type 1)
-	if callData.Call[1].Type != "1" {
-		t.Errorf("expected incoming call type '1', got '%s'", callData.Call[1].Type)
+	if diff := cmp.Diff([]string{"Duration", "Number"}, missingErr.Columns); diff != "" {
+		t.Errorf("unexpected missing columns. diff: \n\n%s", diff)
 	}
 }
 
-// TestServiceTypeParsing tests that service types are correctly parsed
-func TestServiceTypeParsing(t *testing.T) {
-	tests := []struct {
-		name            string
-		serviceField    string
-		expectedService string
-	}{
-		{
-			name:            "Phone with number",
-			serviceField:    "Phone: +1234567890",
-			expectedService: "Phone",
-		},
-		{
-			name:            "WhatsApp Video",
-			serviceField:    "‎WhatsApp Video",
-			expectedService: "‎WhatsApp Video",
-		},
-		{
-			name:            "Signal Audio",
-			serviceField:    "Signal Audio",
-			expectedService: "Signal Audio",
-		},
-		{
-			name:            "Teams Audio",
-			serviceField:    "Teams Audio",
-			expectedService: "Teams Audio",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			tmpDir := t.TempDir()
-			csvPath := filepath.Join(tmpDir, "test.csv")
+// TestConvertReader tests conversion from a reader into an in-memory collection
+func TestConvertReader(t *testing.T) {
+	csvData := `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1234567890,2024-01-01 12:00:00,,,,SMS,Incoming,+1234567890,Test Contact,Read,,,Hello,,`
 
-			csvData := fmt.Sprintf(`Call type,Date,Duration,Number,Contact,Location,Service
-Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,%s`, tt.serviceField)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
 
-			if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
-				t.Fatalf("failed to write temp CSV: %v", err)
-			}
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
 
-			logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-				Level: slog.LevelError,
-			}))
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+	if result.FileType != MessageHistoryFile {
+		t.Fatalf("expected MessageHistoryFile, got %v", result.FileType)
+	}
+	if result.Rows != 1 {
+		t.Errorf("expected 1 row, got %d", result.Rows)
+	}
+	if _, err := app.AppendResult(result); err != nil {
+		t.Fatalf("AppendResult() error = %v", err)
+	}
 
-			app, err := NewApplication(logger, WithCsvFile(csvPath))
-			if err != nil {
-				t.Fatalf("failed to create application: %v", err)
-			}
+	var buf bytes.Buffer
+	if err := app.AppendTo(&buf); err != nil {
+		t.Fatalf("AppendTo() error = %v", err)
+	}
+	var collection sbrdata.Collection
+	if err := json.Unmarshal(buf.Bytes(), &collection); err != nil {
+		t.Fatalf("failed to unmarshal collection: %v", err)
+	}
+	if len(collection.Sms) != 1 {
+		t.Fatalf("expected 1 SMS in collection, got %d", len(collection.Sms))
+	}
+	if collection.Sms[0].Body != "Hello" {
+		t.Errorf("expected body 'Hello', got '%s'", collection.Sms[0].Body)
+	}
+}
 
-			result, _, err := app.Convert()
-			if err != nil {
-				t.Fatalf("Convert() error = %v", err)
-			}
+// TestConvertWarnings tests that unknown columns are reported as warnings
+func TestConvertWarnings(t *testing.T) {
+	csvData := `Call type,Date,Duration,Number,Contact,Favorite
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,yes`
 
-			callData := result.(*sbrdata.Calls)
-			if len(callData.Call) != 1 {
-				t.Fatalf("expected 1 call, got %d", len(callData.Call))
-			}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
 
-			if callData.Call[0].ServiceType == nil {
-				t.Fatal("expected ServiceType to be set, got nil")
-			}
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
 
-			if *callData.Call[0].ServiceType != tt.expectedService {
-				t.Errorf("expected service type '%s', got '%s'", tt.expectedService, *callData.Call[0].ServiceType)
-			}
-		})
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+	expected := []Warning{{Line: 1, Message: `unknown column "Favorite" in header, ignoring`}}
+	if diff := cmp.Diff(expected, result.Warnings); diff != "" {
+		t.Errorf("unexpected warnings. diff: \n\n%s", diff)
 	}
 }
 
-// TestDateConversion tests that dates are correctly converted to Unix milliseconds
-func TestDateConversion(t *testing.T) {
+// TestAppendDeduplicates tests that appending the same export twice does not duplicate records
+func TestAppendDeduplicates(t *testing.T) {
 	tmpDir := t.TempDir()
-	csvPath := filepath.Join(tmpDir, "test.csv")
+	csvPath := filepath.Join(tmpDir, "calls.csv")
+	collectionPath := filepath.Join(tmpDir, "collection.json")
 
-	// Use a known date: 2024-03-15 14:30:00 UTC
 	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
-Outgoing,2024-03-15 14:30:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890`
-
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890
+Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210
+Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210`
 	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
 		t.Fatalf("failed to write temp CSV: %v", err)
 	}
@@ -305,136 +338,1653 @@ Outgoing,2024-03-15 14:30:00,00:01:00,+1234567890,Test Contact,USA,Phone: +12345
 		Level: slog.LevelError,
 	}))
 
-	app, err := NewApplication(logger, WithCsvFile(csvPath))
-	if err != nil {
-		t.Fatalf("failed to create application: %v", err)
+	expected := []AppendStats{
+		{Added: 2, Duplicates: 1},
+		{Added: 0, Duplicates: 3},
+	}
+	for i, exp := range expected {
+		// use a new application for each run so the collection is read from disk
+		app, err := NewApplication(logger, WithCsvFile(csvPath), WithCollectionFile(collectionPath), WithTimezone(time.UTC))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		result, err := app.Convert()
+		if err != nil {
+			t.Fatalf("Convert() error = %v", err)
+		}
+		stats, err := app.AppendResult(result)
+		if err != nil {
+			t.Fatalf("AppendResult() error = %v", err)
+		}
+		if stats != exp {
+			t.Errorf("run %d: expected %+v, got %+v", i+1, exp, stats)
+		}
 	}
 
-	result, _, err := app.Convert()
+	collection, err := sbrdata.LoadCollection(collectionPath)
 	if err != nil {
-		t.Fatalf("Convert() error = %v", err)
+		t.Fatalf("failed to load collection: %v", err)
 	}
-
-	callData := result.(*sbrdata.Calls)
-	if len(callData.Call) != 1 {
-		t.Fatalf("expected 1 call, got %d", len(callData.Call))
+	if len(collection.Calls) != 2 {
+		t.Errorf("expected 2 calls in collection, got %d", len(collection.Calls))
 	}
+}
 
-	// Verify the date is a valid Unix timestamp in milliseconds
-	if callData.Call[0].Date == "" {
-		t.Error("expected Date to be set")
-	}
+// TestTags tests tagging imported records and removing them by tag
+func TestTags(t *testing.T) {
+	tmpDir := t.TempDir()
+	collectionPath := filepath.Join(tmpDir, "collection.json")
 
-	// Verify ReadableDate matches input
-	if callData.Call[0].ReadableDate != "2024-03-15 14:30:00" {
-		t.Errorf("expected ReadableDate '2024-03-15 14:30:00', got '%s'", callData.Call[0].ReadableDate)
-	}
-}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
 
-// parseOptions parses the options.txt content into a map
-func parseOptions(data []byte) map[string]string {
-	options := make(map[string]string)
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	imports := []struct {
+		tag     string
+		csvData string
+	}{
+		{tag: "first", csvData: `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890
+Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210`},
+		{tag: "second", csvData: `Call type,Date,Duration,Number,Contact,Location,Service
+Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210
+Incoming,2024-01-02 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210`},
+	}
+	for _, imp := range imports {
+		app, err := NewApplication(logger, WithCollectionFile(collectionPath), WithTag(imp.tag), WithTimezone(time.UTC))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
 		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		result, err := app.ConvertReader(context.Background(), strings.NewReader(imp.csvData))
+		if err != nil {
+			t.Fatalf("ConvertReader() error = %v", err)
+		}
+		if _, err := app.AppendResult(result); err != nil {
+			t.Fatalf("AppendResult() error = %v", err)
 		}
 	}
-	return options
-}
 
-// verifyCallData verifies call data against expected options
-func verifyCallData(t *testing.T, callData *sbrdata.Calls, options map[string]string) {
-	t.Helper()
+	app, err := NewApplication(logger, WithCollectionFile(collectionPath))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	tags, err := app.Tags()
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	// the duplicate call of the second import belongs to the first import only
+	if diff := cmp.Diff(map[string]int{"first": 2, "second": 1}, tags); diff != "" {
+		t.Errorf("unexpected tags. diff: \n\n%s", diff)
+	}
 
-	// Verify count
-	if expectedCount, ok := options["expected_count"]; ok {
-		actualCount := len(callData.Call)
-		if fmt.Sprintf("%d", actualCount) != expectedCount {
-			t.Errorf("expected %s calls, got %d", expectedCount, actualCount)
-		}
-		if callData.Count != expectedCount {
-			t.Errorf("expected Count field to be %s, got %s", expectedCount, callData.Count)
-		}
+	// removing an unknown tag does not write the collection, so no backup is rotated
+	unknown, err := NewApplication(logger, WithCollectionFile(collectionPath), WithBackups(3))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	if removed, err := unknown.RemoveTag("missing"); err != nil || removed != 0 {
+		t.Errorf("RemoveTag(%q) = (%d, %v), expected (0, nil)", "missing", removed, err)
+	}
+	if _, err := os.Stat(collectionPath + ".1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no backup after removing an unknown tag, got %v", err)
 	}
 
-	// Verify call types
-	if expectedTypes, ok := options["expected_types"]; ok {
-		types := strings.Split(expectedTypes, ",")
-		if len(types) != len(callData.Call) {
-			t.Errorf("expected %d type values, got %d calls", len(types), len(callData.Call))
-		} else {
-			for i, expectedType := range types {
-				if callData.Call[i].Type != strings.TrimSpace(expectedType) {
-					t.Errorf("call %d: expected type %s, got %s", i, expectedType, callData.Call[i].Type)
-				}
-			}
-		}
+	removed, err := app.RemoveTag("first")
+	if err != nil {
+		t.Fatalf("RemoveTag() error = %v", err)
 	}
+	if removed != 2 {
+		t.Errorf("expected 2 removed records, got %d", removed)
+	}
+	collection, err := sbrdata.LoadCollection(collectionPath)
+	if err != nil {
+		t.Fatalf("failed to load collection: %v", err)
+	}
+	if len(collection.Calls) != 1 || collection.Calls[0].ReadableDate != "2024-01-02 13:00:00" {
+		t.Errorf("expected only the call of the second import to remain, got %v", collection.Calls)
+	}
+}
 
-	// Verify service type
-	if expectedService, ok := options["expected_service"]; ok {
-		for i, call := range callData.Call {
-			if call.ServiceType == nil {
-				t.Errorf("call %d: expected ServiceType to contain '%s', got nil", i, expectedService)
-			} else if !strings.Contains(*call.ServiceType, expectedService) {
-				t.Errorf("call %d: expected ServiceType to contain '%s', got '%s'", i, expectedService, *call.ServiceType)
-			}
-		}
+// TestUnresolvedOutgoingAddress tests that sessions without a known counterpart are reported
+func TestUnresolvedOutgoingAddress(t *testing.T) {
+	csvData := `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
+Book Club,2024-01-01 12:00:00,,,,iMessage,Outgoing,,,Sent,,,Anyone there?,,
+Book Club,2024-01-01 12:05:00,,,,iMessage,Outgoing,,,Sent,,,Hello?,,`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
 	}
 
-	// Verify all calls have DataFrom set to "iMazing"
-	for i, call := range callData.Call {
-		if call.DataFrom == nil {
-			t.Errorf("call %d: expected DataFrom to be set", i)
-		} else if *call.DataFrom != "iMazing" {
-			t.Errorf("call %d: expected DataFrom 'iMazing', got '%s'", i, *call.DataFrom)
-		}
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+	expected := []Warning{{Line: 2, Message: `cannot determine the address of outgoing messages in chat session "Book Club"`}}
+	if diff := cmp.Diff(expected, result.Warnings); diff != "" {
+		t.Errorf("unexpected warnings. diff: \n\n%s", diff)
 	}
 }
 
-// verifyMessageData verifies message data against expected options
-func verifyMessageData(t *testing.T, messageData *sbrdata.Messages, options map[string]string) {
-	t.Helper()
+// TestReplies tests that replies are linked to the messages they refer to
+func TestReplies(t *testing.T) {
+	csvData := `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555123456,2024-01-01 12:00:00,,,,iMessage,Incoming,+1555123456,Test Contact,Read,,,Lunch?,,
++1555123456,2024-01-01 12:01:00,,,,iMessage,Outgoing,,,Read,Lunch?,,Yes!,,`
 
-	// Verify SMS count
-	if expectedCount, ok := options["expected_sms_count"]; ok {
-		actualCount := len(messageData.Sms)
-		if fmt.Sprintf("%d", actualCount) != expectedCount {
-			t.Errorf("expected %s SMS messages, got %d", expectedCount, actualCount)
-		}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
 	}
 
-	// Verify message types
-	if expectedTypes, ok := options["expected_types"]; ok {
-		types := strings.Split(expectedTypes, ",")
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+	expected := []Reply{{
+		Line:           3,
+		Date:           "1704110460000",
+		Reference:      "Lunch?",
+		Found:          true,
+		ReplyToDate:    "1704110400000",
+		ReplyToAddress: "+1555123456",
+		ReplyToBody:    "Lunch?",
+	}}
+	if diff := cmp.Diff(expected, result.Replies); diff != "" {
+		t.Errorf("unexpected replies. diff: \n\n%s", diff)
+	}
+	// without reply context the text is left unchanged
+	if result.Messages.Sms[1].Body != "Yes!" {
+		t.Errorf("expected body 'Yes!', got '%s'", result.Messages.Sms[1].Body)
+	}
+}
+
+// TestParseTapback tests detection of reactions in all supported languages
+func TestParseTapback(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected reaction
+		ok       bool
+	}{
+		{body: "Liked “Sure! How about 3pm?”", expected: reaction{name: "Liked", quoted: "Sure! How about 3pm?"}, ok: true},
+		{body: "Laughed at \"That's hilarious\"", expected: reaction{name: "Laughed at", quoted: "That's hilarious"}, ok: true},
+		{body: "Reacted 🎉 to “We won!”", expected: reaction{name: "🎉", quoted: "We won!"}, ok: true},
+		{body: "Gefällt „Bis morgen“", expected: reaction{name: "Liked", quoted: "Bis morgen"}, ok: true},
+		{body: "Gefällt „Bis morgen“ nicht", expected: reaction{name: "Disliked", quoted: "Bis morgen"}, ok: true},
+		{body: "Hat „Bis morgen“ geliebt", expected: reaction{name: "Loved", quoted: "Bis morgen"}, ok: true},
+		{body: "A aimé « À demain »", expected: reaction{name: "Liked", quoted: "À demain"}, ok: true},
+		{body: "Se rió de “Hasta mañana”", expected: reaction{name: "Laughed at", quoted: "Hasta mañana"}, ok: true},
+		{body: "Loved an image", expected: reaction{name: "Loved", quoted: "an image", attachment: true}, ok: true},
+		{body: "Liked a photo", expected: reaction{name: "Liked", quoted: "a photo", attachment: true}, ok: true},
+		{body: "Reacted 🎉 to a video", expected: reaction{name: "🎉", quoted: "a video", attachment: true}, ok: true},
+		{body: "Hat ein Bild geliebt", expected: reaction{name: "Loved", quoted: "ein Bild", attachment: true}, ok: true},
+		{body: "A aimé une photo", expected: reaction{name: "Liked", quoted: "une photo", attachment: true}, ok: true},
+		{body: "Le encanta una imagen", expected: reaction{name: "Loved", quoted: "una imagen", attachment: true}, ok: true},
+		{body: "Removed a heart from “Sure! How about 3pm?”", expected: reaction{name: "Loved", quoted: "Sure! How about 3pm?", removed: true}, ok: true},
+		{body: "Removed a like from an image", expected: reaction{name: "Liked", quoted: "an image", attachment: true, removed: true}, ok: true},
+		{body: "Removed 🎉 from “We won!”", expected: reaction{name: "🎉", quoted: "We won!", removed: true}, ok: true},
+		{body: "Hat ein Herz von „Bis morgen“ entfernt", expected: reaction{name: "Loved", quoted: "Bis morgen", removed: true}, ok: true},
+		{body: "A retiré un cœur de « À demain »", expected: reaction{name: "Loved", quoted: "À demain", removed: true}, ok: true},
+		{body: "Eliminó un corazón de “Hasta mañana”", expected: reaction{name: "Loved", quoted: "Hasta mañana", removed: true}, ok: true},
+		{body: "I liked the movie", ok: false},
+		{body: "Liked it", ok: false},
+		{body: "Liked a lot", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			got, ok := parseTapback(tt.body)
+			if ok != tt.ok || got != tt.expected {
+				t.Errorf("parseTapback(%q) = (%+v, %v), expected (%+v, %v)", tt.body, got, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
+// TestTapbackPolicies tests the counts reported for each tapback policy
+func TestTapbackPolicies(t *testing.T) {
+	csvData := `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555123456,2024-01-01 12:00:00,,,,iMessage,Incoming,+1555123456,Test Contact,Read,,,Lunch?,,
++1555123456,2024-01-01 12:01:00,,,,iMessage,Outgoing,,,Read,,,Liked “Lunch?”,,
++1555123456,2024-01-01 12:02:00,,,,iMessage,Incoming,+1555123456,Test Contact,Read,,,Loved “Something older”,,
++1555123456,2024-01-01 12:03:00,,,,iMessage,Outgoing,,,Read,,,Removed a like from “Lunch?”,,`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	tests := []struct {
+		policy   TapbackPolicy
+		expected TapbackStats
+		sms      int
+	}{
+		{policy: TapbackKeep, expected: TapbackStats{Kept: 3}, sms: 4},
+		{policy: TapbackDrop, expected: TapbackStats{Dropped: 3}, sms: 1},
+		{policy: TapbackFold, expected: TapbackStats{Kept: 1, Folded: 2}, sms: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			app, err := NewApplication(logger, WithTimezone(time.UTC), WithTapbackPolicy(tt.policy))
+			if err != nil {
+				t.Fatalf("failed to create application: %v", err)
+			}
+			result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+			if err != nil {
+				t.Fatalf("ConvertReader() error = %v", err)
+			}
+			if result.Tapbacks != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, result.Tapbacks)
+			}
+			if len(result.Messages.Sms) != tt.sms {
+				t.Errorf("expected %d SMS, got %d", tt.sms, len(result.Messages.Sms))
+			}
+		})
+	}
+}
+
+// TestNormalizeNumber tests the normalization of phone numbers to E.164 format
+func TestNormalizeNumber(t *testing.T) {
+	tests := []struct {
+		input       string
+		countryCode string
+		expected    string
+	}{
+		{input: "+1234567890", countryCode: "49", expected: "+1234567890"},
+		{input: "+49 171 1234567", countryCode: "", expected: "+491711234567"},
+		{input: "0049 171 1234567", countryCode: "1", expected: "+491711234567"},
+		{input: "0171 1234567", countryCode: "49", expected: "+491711234567"},
+		{input: "0171 1234567", countryCode: "", expected: "01711234567"},
+		{input: "(555) 123-4567", countryCode: "1", expected: "+15551234567"},
+		{input: "1 (555) 123-4567", countryCode: "1", expected: "+15551234567"},
+		{input: "030/1234567", countryCode: "49", expected: "+49301234567"},
+		{input: "22333", countryCode: "49", expected: "22333"},
+		{input: "john@example.com", countryCode: "49", expected: "john@example.com"},
+		{input: "AB123456-7890-ABCD-EF12-34567890ABCD", countryCode: "49", expected: "AB123456-7890-ABCD-EF12-34567890ABCD"},
+		{input: "Daily Standup", countryCode: "49", expected: "Daily Standup"},
+		{input: "", countryCode: "49", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := normalizeNumber(tt.input, tt.countryCode); got != tt.expected {
+				t.Errorf("normalizeNumber(%q, %q) = %q, expected %q", tt.input, tt.countryCode, got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestParseCountryCode tests the accepted forms of country calling codes
+func TestParseCountryCode(t *testing.T) {
+	for input, expected := range map[string]string{"49": "49", "+49": "49", "0049": "49", " 1 ": "1"} {
+		got, err := parseCountryCode(input)
+		if err != nil || got != expected {
+			t.Errorf("parseCountryCode(%q) = (%q, %v), expected %q", input, got, err, expected)
+		}
+	}
+	for _, input := range []string{"", "+", "DE", "0", "1234"} {
+		if _, err := parseCountryCode(input); !errors.Is(err, ErrInvalidCountryCode) {
+			t.Errorf("parseCountryCode(%q) error = %v, expected ErrInvalidCountryCode", input, err)
+		}
+	}
+}
+
+// TestParseVCards tests reading contacts from vCard files of different versions
+func TestParseVCards(t *testing.T) {
+	vcf := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Doe;John;;;\r\nFN:John Doe\r\nitem1.TEL;type=CELL;type=VOICE;type=pref:+1 (234) 56\r\n 7-890\r\nEMAIL;type=INTERNET:John@Example.com\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\nVERSION:2.1\nN;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:M=C3=BCller;J=C3=BCrgen;;;\nTEL;CELL:0171 1234567\nEND:VCARD\n" +
+		"BEGIN:VCARD\nVERSION:4.0\nORG:ACME\\, Inc.;Sales\nTEL;VALUE=uri:tel:+49-30-1234567\nEND:VCARD\n" +
+		"BEGIN:VCARD\nVERSION:3.0\nTEL:+1555000000\nEND:VCARD\n"
+
+	contacts, err := parseVCards(strings.NewReader(vcf))
+	if err != nil {
+		t.Fatalf("parseVCards() error = %v", err)
+	}
+	expected := []contact{
+		{name: "John Doe", numbers: []string{"+1 (234) 567-890"}, emails: []string{"John@Example.com"}},
+		{name: "Jürgen Müller", numbers: []string{"0171 1234567"}},
+		{name: "ACME, Inc.", numbers: []string{"+49-30-1234567"}},
+	}
+	if diff := cmp.Diff(expected, contacts, cmp.AllowUnexported(contact{})); diff != "" {
+		t.Errorf("contacts mismatch (-expected +got):\n%s", diff)
+	}
+
+	index := newContactIndex(contacts, "49")
+	for handle, name := range map[string]string{
+		"+1234567890":      "John Doe",
+		"john@example.com": "John Doe",
+		"+491711234567":    "Jürgen Müller",
+		"030 1234567":      "ACME, Inc.",
+	} {
+		if got := index[contactKey(handle, "49")]; got != name {
+			t.Errorf("contact of %q = %q, expected %q", handle, got, name)
+		}
+	}
+}
+
+// TestCallPolicies tests skipping and rewriting calls by service
+func TestCallPolicies(t *testing.T) {
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-05-20 09:00:00,00:30:00,Daily Standup,Daily Standup,,Teams Audio
+Incoming,2024-05-20 10:00:00,00:10:00,Project Review,Project Review,,Teams Video
+Outgoing,2024-05-20 11:00:00,00:03:45,AB123456-7890-ABCD-EF12-34567890ABCD,Emma Davis,,Signal Audio
+Incoming,2024-05-20 12:00:00,00:01:00,+1234567890,John Doe,United States,Phone: +1234567890
+Incoming,2024-05-20 13:00:00,00:02:00,+1122334455,Bob Johnson,Canada,‎WhatsApp Video`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	policies, err := ParseCallPolicies("Teams=skip, Signal Audio=rewrite, *=skip, Phone=import")
+	if err != nil {
+		t.Fatalf("ParseCallPolicies() error = %v", err)
+	}
+	opts := []ApplicationOption{WithTimezone(time.UTC)}
+	for service, policy := range policies {
+		opts = append(opts, WithCallPolicy(service, policy))
+	}
+	app, err := NewApplication(logger, opts...)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+
+	if diff := cmp.Diff(map[string]int{"Teams Audio": 1, "Teams Video": 1, "WhatsApp Video": 1}, result.SkippedCalls); diff != "" {
+		t.Errorf("skipped calls mismatch (-expected +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]int{"Signal Audio": 1}, result.RewrittenCalls); diff != "" {
+		t.Errorf("rewritten calls mismatch (-expected +got):\n%s", diff)
+	}
+	calls := result.Calls.Call
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(calls))
+	}
+	if calls[0].Number != "" || calls[0].Presentation != sbrPresentationUnknown || calls[0].ContactName != "Emma Davis" {
+		t.Errorf("expected rewritten Signal call, got %+v", calls[0])
+	}
+	if calls[1].Number != "+1234567890" {
+		t.Errorf("expected phone call to be imported unchanged, got %+v", calls[1])
+	}
+
+	for _, spec := range []string{"Teams", "Teams=maybe", "=skip"} {
+		if _, err := ParseCallPolicies(spec); !errors.Is(err, ErrUnknownCallPolicy) {
+			t.Errorf("ParseCallPolicies(%q) error = %v, expected ErrUnknownCallPolicy", spec, err)
+		}
+	}
+}
+
+// TestCallPresentation tests the caller ID presentation of localized placeholders
+func TestCallPresentation(t *testing.T) {
+	de, err := lookupLocale("de")
+	if err != nil {
+		t.Fatalf("lookupLocale() error = %v", err)
+	}
+	conv := &conversion{loc: de}
+	tests := []struct {
+		number      string
+		contactName string
+		expected    string
+	}{
+		{number: "+491711234567", contactName: "Max Mustermann", expected: sbrPresentationAllowed},
+		{number: "Keine Anrufer-ID", expected: sbrPresentationRestricted},
+		{contactName: "keine anrufer-id", expected: sbrPresentationRestricted},
+		{number: "Unbekannt", expected: sbrPresentationUnknown},
+		{number: "Münztelefon", expected: sbrPresentationPayphone},
+		{number: "No Caller ID", expected: sbrPresentationRestricted},
+		{expected: sbrPresentationUnknown},
+	}
+	for _, tt := range tests {
+		if got := callPresentation(conv, tt.number, tt.contactName); got != tt.expected {
+			t.Errorf("callPresentation(%q, %q) = %q, expected %q", tt.number, tt.contactName, got, tt.expected)
+		}
+	}
+}
+
+// TestNormalizeInput tests the detection of byte order marks, encodings and delimiters
+func TestNormalizeInput(t *testing.T) {
+	utf16le := func(v string, bom bool) []byte {
+		var b []byte
+		if bom {
+			b = append(b, 0xFF, 0xFE)
+		}
+		for _, u := range utf16.Encode([]rune(v)) {
+			b = binary.LittleEndian.AppendUint16(b, u)
+		}
+		return b
+	}
+	utf16be := func(v string, bom bool) []byte {
+		var b []byte
+		if bom {
+			b = append(b, 0xFE, 0xFF)
+		}
+		for _, u := range utf16.Encode([]rune(v)) {
+			b = binary.BigEndian.AppendUint16(b, u)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+		format   inputFormat
+	}{
+		{name: "plain", input: []byte("a,b\n1,2\n"), expected: "a,b\n1,2\n", format: inputFormat{encoding: "utf-8", delimiter: ','}},
+		{name: "utf-8 bom", input: []byte("\ufeffa,b\r\n1,2\r\n"), expected: "a,b\r\n1,2\r\n", format: inputFormat{encoding: "utf-8", bom: true, delimiter: ','}},
+		{name: "semicolon", input: []byte("a;b;c\n1,5;2;3\n"), expected: "a;b;c\n1,5;2;3\n", format: inputFormat{encoding: "utf-8", delimiter: ';'}},
+		{name: "tab", input: []byte("a b\tc\n"), expected: "a b\tc\n", format: inputFormat{encoding: "utf-8", delimiter: '\t'}},
+		{name: "quoted delimiter", input: []byte("\"a;b\",c\n"), expected: "\"a;b\",c\n", format: inputFormat{encoding: "utf-8", delimiter: ','}},
+		{name: "utf-16le bom", input: utf16le("Typ;Text\nü;😀\n", true), expected: "Typ;Text\nü;😀\n", format: inputFormat{encoding: "utf-16le", bom: true, delimiter: ';'}},
+		{name: "utf-16be bom", input: utf16be("a\tb\n", true), expected: "a\tb\n", format: inputFormat{encoding: "utf-16be", bom: true, delimiter: '\t'}},
+		{name: "utf-16le", input: utf16le("a,b\n", false), expected: "a,b\n", format: inputFormat{encoding: "utf-16le", delimiter: ','}},
+		{name: "empty", input: nil, expected: "", format: inputFormat{encoding: "utf-8", delimiter: ','}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, format, err := normalizeInput(bytes.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("normalizeInput() error = %v", err)
+			}
+			if format != tt.format {
+				t.Errorf("expected format %+v, got %+v", tt.format, format)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read normalized input: %v", err)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, string(data))
+			}
+		})
+	}
+}
+
+// TestLenient tests skipping malformed rows in lenient mode and the line numbers of errors in strict mode
+func TestLenient(t *testing.T) {
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-03-15 14:30:00,00:02:45,+1234567890,John Doe,United States,Phone: +1234567890
+Incoming,yesterday,00:01:20,+9876543210,Jane Smith,United Kingdom,Phone: +9876543210
+Incoming,2024-03-15 16:00:00,00:01:20,+9876543210
+Outgoing,2024-03-15 17:00:00,00:00:10,+1122334455,Bob "The Builder" Johnson,Canada,Phone: +1122334455
+Outgoing,2024-03-15 18:00:00,00:00:30,+1234567890,John Doe,United States,Phone: +1234567890`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	t.Run("strict", func(t *testing.T) {
+		app, err := NewApplication(logger, WithTimezone(time.UTC))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		_, err = app.ConvertReader(context.Background(), strings.NewReader(csvData))
+		var rowErr *RowError
+		if !errors.As(err, &rowErr) {
+			t.Fatalf("expected RowError, got %v", err)
+		}
+		if rowErr.Line != 3 || rowErr.Column != "Date" || rowErr.Value != "yesterday" {
+			t.Errorf("unexpected row error %+v", rowErr)
+		}
+		if !strings.HasPrefix(err.Error(), "line 3: ") {
+			t.Errorf("expected error to start with the line number, got %q", err)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		app, err := NewApplication(logger, WithTimezone(time.UTC), WithLenient(true))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+		if err != nil {
+			t.Fatalf("ConvertReader() error = %v", err)
+		}
+		if len(result.Calls.Call) != 2 {
+			t.Errorf("expected 2 calls, got %d", len(result.Calls.Call))
+		}
+		if result.Rows != 5 {
+			t.Errorf("expected 5 rows, got %d", result.Rows)
+		}
+
+		var report bytes.Buffer
+		if err := result.WriteErrorReport(&report); err != nil {
+			t.Fatalf("WriteErrorReport() error = %v", err)
+		}
+		var skipped []map[string]any
+		if err := json.Unmarshal(report.Bytes(), &skipped); err != nil {
+			t.Fatalf("failed to parse error report: %v", err)
+		}
+		if len(skipped) != 3 {
+			t.Fatalf("expected 3 skipped rows, got %d: %s", len(skipped), report.String())
+		}
+		for i, line := range []float64{3, 4, 5} {
+			if skipped[i]["line"] != line || skipped[i]["reason"] == "" {
+				t.Errorf("unexpected skipped row %d: %v", i, skipped[i])
+			}
+		}
+		if skipped[0]["column"] != "Date" || skipped[0]["value"] != "yesterday" {
+			t.Errorf("expected the invalid date to be reported, got %v", skipped[0])
+		}
+	})
+}
+
+// TestConvertReaderCanceled tests that ConvertReader stops on a canceled context
+func TestConvertReaderCanceled(t *testing.T) {
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger)
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = app.ConvertReader(ctx, strings.NewReader(csvData))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestCallTypeMapping tests that call types are correctly mapped
+func TestCallTypeMapping(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890
+Incoming,2024-01-01 13:00:00,00:02:00,+9876543210,Test Contact 2,USA,Phone: +9876543210`
+
+	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+		t.Fatalf("failed to write temp CSV: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithCsvFile(csvPath))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+
+	result, err := app.Convert()
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+
+	callData := result.Calls
+	if len(callData.Call) != 2 {
+		t.Fatalf("expected 2 calls, got %d", len(callData.Call))
+	}
+
+	// First call should be Outgoing (type 2)
+	if callData.Call[0].Type != "2" {
+		t.Errorf("expected outgoing call type '2', got '%s'", callData.Call[0].Type)
+	}
+
+	// Second call should be Incoming (type 1)
+	if callData.Call[1].Type != "1" {
+		t.Errorf("expected incoming call type '1', got '%s'", callData.Call[1].Type)
+	}
+}
+
+// TestUnknownCallType tests that unknown call types are reported as warnings
+func TestUnknownCallType(t *testing.T) {
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Forwarded,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890`
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+
+	result, err := app.ConvertReader(context.Background(), strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("ConvertReader() error = %v", err)
+	}
+	if result.Calls.Call[0].Type != "1" {
+		t.Errorf("expected unknown call type to be imported as '1', got '%s'", result.Calls.Call[0].Type)
+	}
+	expected := []Warning{{Line: 2, Message: `unknown call type "Forwarded", importing as incoming call`}}
+	if diff := cmp.Diff(expected, result.Warnings); diff != "" {
+		t.Errorf("unexpected warnings. diff: \n\n%s", diff)
+	}
+}
+
+// TestServiceTypeParsing tests that service types are correctly parsed
+func TestServiceTypeParsing(t *testing.T) {
+	tests := []struct {
+		name            string
+		serviceField    string
+		expectedService string
+	}{
+		{
+			name:            "Phone with number",
+			serviceField:    "Phone: +1234567890",
+			expectedService: "Phone",
+		},
+		{
+			name:            "WhatsApp Video",
+			serviceField:    "‎WhatsApp Video",
+			expectedService: "‎WhatsApp Video",
+		},
+		{
+			name:            "Signal Audio",
+			serviceField:    "Signal Audio",
+			expectedService: "Signal Audio",
+		},
+		{
+			name:            "Teams Audio",
+			serviceField:    "Teams Audio",
+			expectedService: "Teams Audio",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			csvPath := filepath.Join(tmpDir, "test.csv")
+
+			csvData := fmt.Sprintf(`Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-01-01 12:00:00,00:01:00,+1234567890,Test Contact,USA,%s`, tt.serviceField)
+
+			if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+				t.Fatalf("failed to write temp CSV: %v", err)
+			}
+
+			logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+				Level: slog.LevelError,
+			}))
+
+			app, err := NewApplication(logger, WithCsvFile(csvPath))
+			if err != nil {
+				t.Fatalf("failed to create application: %v", err)
+			}
+
+			result, err := app.Convert()
+			if err != nil {
+				t.Fatalf("Convert() error = %v", err)
+			}
+
+			callData := result.Calls
+			if len(callData.Call) != 1 {
+				t.Fatalf("expected 1 call, got %d", len(callData.Call))
+			}
+
+			if callData.Call[0].ServiceType == nil {
+				t.Fatal("expected ServiceType to be set, got nil")
+			}
+
+			if *callData.Call[0].ServiceType != tt.expectedService {
+				t.Errorf("expected service type '%s', got '%s'", tt.expectedService, *callData.Call[0].ServiceType)
+			}
+		})
+	}
+}
+
+// TestParseDuration tests parsing of call durations into seconds
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+		wantErr  bool
+	}{
+		{value: "00:02:45", expected: 165},
+		{value: "1:02:45", expected: 3765},
+		{value: "02:45", expected: 165},
+		{value: "00:00:00", expected: 0},
+		{value: "00:00:02,6", expected: 3},
+		{value: "00:00:02.4", expected: 2},
+		{value: "", expected: 0},
+		{value: "75", expected: 75},
+		{value: "1h 2m 3s", expected: 3723},
+		{value: "2 min 45 sec", expected: 165},
+		{value: "1 Std. 5 Sek.", expected: 3605},
+		{value: "00:61:00", wantErr: true},
+		{value: "1:2:3:4", wantErr: true},
+		{value: "abc", wantErr: true},
+		{value: "-5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			seconds, err := parseDuration(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDuration(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if seconds != tt.expected {
+				t.Errorf("parseDuration(%q) = %d, expected %d", tt.value, seconds, tt.expected)
+			}
+		})
+	}
+}
+
+// TestDateConversion tests that dates are correctly converted to Unix milliseconds
+func TestDateConversion(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	// Use a known date: 2024-03-15 14:30:00 UTC
+	csvData := `Call type,Date,Duration,Number,Contact,Location,Service
+Outgoing,2024-03-15 14:30:00,00:01:00,+1234567890,Test Contact,USA,Phone: +1234567890`
+
+	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+		t.Fatalf("failed to write temp CSV: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithCsvFile(csvPath))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+
+	result, err := app.Convert()
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+
+	callData := result.Calls
+	if len(callData.Call) != 1 {
+		t.Fatalf("expected 1 call, got %d", len(callData.Call))
+	}
+
+	// Verify the date is a valid Unix timestamp in milliseconds
+	if callData.Call[0].Date == "" {
+		t.Error("expected Date to be set")
+	}
+
+	// Verify ReadableDate matches input
+	if callData.Call[0].ReadableDate != "2024-03-15 14:30:00" {
+		t.Errorf("expected ReadableDate '2024-03-15 14:30:00', got '%s'", callData.Call[0].ReadableDate)
+	}
+}
+
+// parseOptions parses the options.txt content into a map
+func parseOptions(data []byte) map[string]string {
+	options := make(map[string]string)
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return options
+}
+
+// verifyCallData verifies call data against expected options
+func verifyCallData(t *testing.T, callData *sbrdata.Calls, options map[string]string) {
+	t.Helper()
+
+	// Verify count
+	if expectedCount, ok := options["expected_count"]; ok {
+		actualCount := len(callData.Call)
+		if fmt.Sprintf("%d", actualCount) != expectedCount {
+			t.Errorf("expected %s calls, got %d", expectedCount, actualCount)
+		}
+		if callData.Count != expectedCount {
+			t.Errorf("expected Count field to be %s, got %s", expectedCount, callData.Count)
+		}
+	}
+
+	// Verify call types
+	if expectedTypes, ok := options["expected_types"]; ok {
+		types := strings.Split(expectedTypes, ",")
+		if len(types) != len(callData.Call) {
+			t.Errorf("expected %d type values, got %d calls", len(types), len(callData.Call))
+		} else {
+			for i, expectedType := range types {
+				if callData.Call[i].Type != strings.TrimSpace(expectedType) {
+					t.Errorf("call %d: expected type %s, got %s", i, expectedType, callData.Call[i].Type)
+				}
+			}
+		}
+	}
+
+	// Verify service type
+	if expectedService, ok := options["expected_service"]; ok {
+		for i, call := range callData.Call {
+			if call.ServiceType == nil {
+				t.Errorf("call %d: expected ServiceType to contain '%s', got nil", i, expectedService)
+			} else if !strings.Contains(*call.ServiceType, expectedService) {
+				t.Errorf("call %d: expected ServiceType to contain '%s', got '%s'", i, expectedService, *call.ServiceType)
+			}
+		}
+	}
+
+	// Verify all calls have DataFrom set to "iMazing"
+	for i, call := range callData.Call {
+		if call.DataFrom == nil {
+			t.Errorf("call %d: expected DataFrom to be set", i)
+		} else if *call.DataFrom != "iMazing" {
+			t.Errorf("call %d: expected DataFrom 'iMazing', got '%s'", i, *call.DataFrom)
+		}
+	}
+}
+
+// verifyMessageData verifies message data against expected options
+func verifyMessageData(t *testing.T, messageData *sbrdata.Messages, options map[string]string) {
+	t.Helper()
+
+	// Verify SMS count
+	if expectedCount, ok := options["expected_sms_count"]; ok {
+		actualCount := len(messageData.Sms)
+		if fmt.Sprintf("%d", actualCount) != expectedCount {
+			t.Errorf("expected %s SMS messages, got %d", expectedCount, actualCount)
+		}
+	}
+
+	// Verify message types
+	if expectedTypes, ok := options["expected_types"]; ok {
+		types := strings.Split(expectedTypes, ",")
 		if len(types) != len(messageData.Sms) {
 			t.Errorf("expected %d type values, got %d messages", len(types), len(messageData.Sms))
 		} else {
-			for i, expectedType := range types {
-				if messageData.Sms[i].Type != strings.TrimSpace(expectedType) {
-					t.Errorf("message %d: expected type %s, got %s", i, expectedType, messageData.Sms[i].Type)
+			for i, expectedType := range types {
+				if messageData.Sms[i].Type != strings.TrimSpace(expectedType) {
+					t.Errorf("message %d: expected type %s, got %s", i, expectedType, messageData.Sms[i].Type)
+				}
+			}
+		}
+	}
+
+	// Verify sender name if specified
+	if expectedSender, ok := options["sender_name"]; ok {
+		for i, sms := range messageData.Sms {
+			// Check if sender name is set (either from Sender Name or Chat Session)
+			if sms.ContactName == "" {
+				t.Errorf("message %d: expected ContactName to be set", i)
+			}
+			// For messages from the expected sender, verify the name matches
+			if strings.Contains(sms.ContactName, expectedSender) || strings.Contains(expectedSender, sms.ContactName) {
+				// Match found, this is expected
+			}
+		}
+	}
+}
+
+// TestStreamMatchesConvert tests that streaming writes the same collection as converting and appending
+func TestStreamMatchesConvert(t *testing.T) {
+	testFiles, err := filepath.Glob("testdata/*.txtar")
+	if err != nil {
+		t.Fatalf("failed to find test files: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	for _, testFile := range testFiles {
+		t.Run(filepath.Base(testFile), func(t *testing.T) {
+			archive, err := txtar.ParseFile(testFile)
+			if err != nil {
+				t.Fatalf("failed to parse txtar file: %v", err)
+			}
+			var inputCSV []byte
+			for _, file := range archive.Files {
+				if file.Name == "input.csv" {
+					inputCSV = file.Data
+				}
+			}
+
+			batch, err := NewApplication(logger, WithTimezone(time.UTC))
+			if err != nil {
+				t.Fatalf("failed to create application: %v", err)
+			}
+			result, err := batch.ConvertReader(context.Background(), bytes.NewReader(inputCSV))
+			if err != nil {
+				t.Fatalf("ConvertReader() error = %v", err)
+			}
+			if _, err := batch.AppendResult(result); err != nil {
+				t.Fatalf("AppendResult() error = %v", err)
+			}
+			var expected bytes.Buffer
+			if err := batch.AppendTo(&expected); err != nil {
+				t.Fatalf("AppendTo() error = %v", err)
+			}
+
+			streaming, err := NewApplication(logger, WithTimezone(time.UTC))
+			if err != nil {
+				t.Fatalf("failed to create application: %v", err)
+			}
+			var got bytes.Buffer
+			if _, _, err := streaming.StreamReader(context.Background(), bytes.NewReader(inputCSV), &got); err != nil {
+				t.Fatalf("StreamReader() error = %v", err)
+			}
+			if diff := cmp.Diff(expected.String(), got.String()); diff != "" {
+				t.Errorf("streamed collection mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestStreamImport tests streaming into an existing collection file
+func TestStreamImport(t *testing.T) {
+	csvData := `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555123456,2024-01-01 12:00:00,,,,SMS,Incoming,+1555123456,Test Contact,Read,,,Hello,,
++1555123456,2024-01-01 12:01:00,,,,SMS,Outgoing,,,Delivered,,,Hi there,,
++1555987654,2024-01-02 09:00:00,,,,SMS,Incoming,+1555987654,Other Contact,Read,,,Good morning,,`
+
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "messages.csv")
+	collectionPath := filepath.Join(tmpDir, "collection.json")
+	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+		t.Fatalf("failed to write CSV file: %v", err)
+	}
+	existing := `{"Key": "phone", "Calls": [{"Number": "+1234567890", "Date": "1700000000000", "Type": "1", "Duration": "60"}], "Sms": null, "Extra": {"ignored": true}}`
+	if err := os.WriteFile(collectionPath, []byte(existing), 0600); err != nil {
+		t.Fatalf("failed to write collection file: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	for i, expected := range []AppendStats{{Added: 3}, {Duplicates: 3}} {
+		app, err := NewApplication(logger, WithCsvFile(csvPath), WithCollectionFile(collectionPath), WithTimezone(time.UTC), WithTag(fmt.Sprintf("run-%d", i)))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		result, stats, err := app.StreamImport(io.Discard)
+		if err != nil {
+			t.Fatalf("StreamImport() error = %v", err)
+		}
+		if stats != expected {
+			t.Errorf("run %d: expected %+v, got %+v", i, expected, stats)
+		}
+		if result.Rows != 3 || len(result.Messages.Sms) != 0 || result.Messages.Count != "3" {
+			t.Errorf("run %d: expected 3 streamed rows, got %d rows, %d SMS, count %s", i, result.Rows, len(result.Messages.Sms), result.Messages.Count)
+		}
+	}
+
+	collection, err := sbrdata.LoadCollection(collectionPath)
+	if err != nil {
+		t.Fatalf("failed to load collection: %v", err)
+	}
+	if collection.Key != "phone" || len(collection.Calls) != 1 || len(collection.Sms) != 3 || len(collection.Mms) != 0 {
+		t.Errorf("unexpected collection: key %q, %d calls, %d SMS, %d MMS", collection.Key, len(collection.Calls), len(collection.Sms), len(collection.Mms))
+	}
+	if collection.Sms[1].Address != "+1555123456" {
+		t.Errorf("expected outgoing message to be addressed to its session, got %q", collection.Sms[1].Address)
+	}
+
+	app, err := NewApplication(logger, WithCollectionFile(collectionPath))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	tags, err := app.Tags()
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"run-0": 3}, tags); diff != "" {
+		t.Errorf("tags mismatch (-expected +got):\n%s", diff)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.tmp"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, found %v", matches)
+	}
+}
+
+// TestMergeTagIndex tests that appending spooled identities to a tag index file gives
+// the same index as appending them in memory
+func TestMergeTagIndex(t *testing.T) {
+	existing := tagIndex{"a": {"a1"}, "run": {"run1", "run2"}, "z": {}}
+	added := []string{"new\x00one", "new <two>"}
+
+	for _, tag := range []string{"run", "m", "0", "zz"} {
+		t.Run(tag, func(t *testing.T) {
+			keys, err := newSpool()
+			if err != nil {
+				t.Fatalf("newSpool() error = %v", err)
+			}
+			defer keys.remove()
+			for _, key := range added {
+				if err := keys.write(key); err != nil {
+					t.Fatalf("write() error = %v", err)
+				}
+			}
+			data, err := json.MarshalIndent(existing, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal index: %v", err)
+			}
+			var merged bytes.Buffer
+			if err := mergeTagIndex(bytes.NewReader(data), &merged, tag, keys); err != nil {
+				t.Fatalf("mergeTagIndex() error = %v", err)
+			}
+
+			expected := tagIndex{}
+			for name, k := range existing {
+				expected[name] = slices.Clone(k)
+			}
+			expected[tag] = append(expected[tag], added...)
+			data, err = json.MarshalIndent(expected, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal index: %v", err)
+			}
+			if diff := cmp.Diff(string(data), merged.String()); diff != "" {
+				t.Errorf("index mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// writeImportDir writes an export folder with a call history, two chats in a
+// subdirectory, a file that is no export and a file that is not a CSV file
+func writeImportDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"Calls.csv": `Call type,Date,Duration,Number,Contact,Location,Service
+Incoming,2024-01-15 10:30:00,00:02:45,+1234567890,Test Contact,Mobile,Phone`,
+		"chats/Alice.CSV": `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555123456,2024-01-01 12:00:00,,,,SMS,Incoming,+1555123456,Alice,Read,,,Hello,,
++1555123456,2024-01-01 12:01:00,,,,SMS,Outgoing,,,Delivered,,,Hi there,,`,
+		"chats/Bob.csv": `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555987654,2024-01-02 09:00:00,,,,SMS,Incoming,+1555987654,Bob,Read,,,Good morning,,`,
+		"chats/broken.csv": "foo,bar\n1,2",
+		"notes.txt":        "not an export",
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+// TestFindImportFiles tests expansion of files, directories and glob patterns to import files
+func TestFindImportFiles(t *testing.T) {
+	dir := writeImportDir(t)
+	calls := filepath.Join(dir, "Calls.csv")
+	alice := filepath.Join(dir, "chats", "Alice.CSV")
+	bob := filepath.Join(dir, "chats", "Bob.csv")
+	broken := filepath.Join(dir, "chats", "broken.csv")
+
+	tests := []struct {
+		name     string
+		paths    []string
+		expected []string
+		err      error
+	}{
+		{name: "directory", paths: []string{dir}, expected: []string{calls, alice, bob, broken}},
+		{name: "glob", paths: []string{filepath.Join(dir, "chats", "[AB]*")}, expected: []string{alice, bob}},
+		{name: "files", paths: []string{bob, calls}, expected: []string{bob, calls}},
+		{name: "duplicates", paths: []string{bob, filepath.Join(dir, "chats")}, expected: []string{bob, alice, broken}},
+		{name: "non-csv file", paths: []string{filepath.Join(dir, "notes.txt")}, expected: []string{filepath.Join(dir, "notes.txt")}},
+		{name: "missing file", paths: []string{filepath.Join(dir, "missing.csv")}, err: ErrImportFileDoesNotExist},
+		{name: "no match", paths: []string{filepath.Join(dir, "*.json")}, err: ErrNoImportFiles},
+		{name: "no paths", err: ErrNoImportFiles},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := FindImportFiles(tt.paths...)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if diff := cmp.Diff(tt.expected, files); diff != "" {
+				t.Errorf("files mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestImportFiles tests importing several files into a collection, tagging and duplicate detection across runs
+func TestImportFiles(t *testing.T) {
+	dir := writeImportDir(t)
+	collectionPath := filepath.Join(t.TempDir(), "collection.json")
+	files, err := FindImportFiles(dir)
+	if err != nil {
+		t.Fatalf("FindImportFiles() error = %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	for i, expected := range [][]AppendStats{
+		{{Added: 1}, {Added: 2}, {Added: 1}, {}},
+		{{Duplicates: 1}, {Duplicates: 2}, {Duplicates: 1}, {}},
+	} {
+		app, err := NewApplication(logger, WithCollectionFile(collectionPath), WithTimezone(time.UTC), WithTag(fmt.Sprintf("run-%d", i)))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		results, err := app.ImportFiles(files...)
+		if err != nil {
+			t.Fatalf("ImportFiles() error = %v", err)
+		}
+		if len(results) != len(files) {
+			t.Fatalf("expected %d results, got %d", len(files), len(results))
+		}
+		for j, r := range results {
+			if r.File != files[j] || r.Stats != expected[j] {
+				t.Errorf("run %d: expected %s with %+v, got %s with %+v", i, files[j], expected[j], r.File, r.Stats)
+			}
+		}
+		if results[0].Result.FileType != CallHistoryFile || results[1].Result.FileType != MessageHistoryFile {
+			t.Errorf("run %d: expected file types to be detected, got %v and %v", i, results[0].Result.FileType, results[1].Result.FileType)
+		}
+		if !errors.Is(results[3].Err, ErrUnsupportedFileFormat) || results[3].Result != nil {
+			t.Errorf("run %d: expected broken file to fail with unsupported format, got %v", i, results[3].Err)
+		}
+	}
+
+	collection, err := sbrdata.LoadCollection(collectionPath)
+	if err != nil {
+		t.Fatalf("failed to load collection: %v", err)
+	}
+	if len(collection.Calls) != 1 || len(collection.Sms) != 3 {
+		t.Errorf("expected 1 call and 3 SMS, got %d calls and %d SMS", len(collection.Calls), len(collection.Sms))
+	}
+
+	app, err := NewApplication(logger, WithCollectionFile(collectionPath))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	tags, err := app.Tags()
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"run-0": 4}, tags); diff != "" {
+		t.Errorf("tags mismatch (-expected +got):\n%s", diff)
+	}
+}
+
+// TestStreamImportFiles tests that streaming several files writes the same collection as importing them in memory
+func TestStreamImportFiles(t *testing.T) {
+	dir := writeImportDir(t)
+	files := []string{
+		filepath.Join(dir, "Calls.csv"),
+		filepath.Join(dir, "chats", "Alice.CSV"),
+		filepath.Join(dir, "chats", "Bob.csv"),
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	if _, err := app.ImportFiles(files...); err != nil {
+		t.Fatalf("ImportFiles() error = %v", err)
+	}
+	var expected bytes.Buffer
+	if err := app.AppendTo(&expected); err != nil {
+		t.Fatalf("AppendTo() error = %v", err)
+	}
+
+	app, err = NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	var streamed bytes.Buffer
+	results, err := app.StreamImportFiles(&streamed, files...)
+	if err != nil {
+		t.Fatalf("StreamImportFiles() error = %v", err)
+	}
+	if diff := cmp.Diff(expected.String(), streamed.String()); diff != "" {
+		t.Errorf("collection mismatch (-batch +stream):\n%s", diff)
+	}
+	for i, added := range []int{1, 2, 1} {
+		if results[i].Stats.Added != added {
+			t.Errorf("%s: expected %d added records, got %+v", results[i].File, added, results[i].Stats)
+		}
+	}
+
+	// a failing file stops the import and leaves the collection unchanged
+	collectionPath := filepath.Join(t.TempDir(), "collection.json")
+	app, err = NewApplication(logger, WithCollectionFile(collectionPath), WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	_, err = app.StreamImportFiles(io.Discard, append(files, filepath.Join(dir, "chats", "broken.csv"))...)
+	if !errors.Is(err, ErrUnsupportedFileFormat) {
+		t.Errorf("expected ErrUnsupportedFileFormat, got %v", err)
+	}
+	if _, err := os.Stat(collectionPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no collection file, got %v", err)
+	}
+}
+
+// writeZipExport writes a ZIP archive with a call history, a chat with an attachment in
+// a subdirectory, the metadata macOS adds and a CSV file that is no export
+func writeZipExport(t *testing.T, dir string) string {
+	t.Helper()
+	archive := filepath.Join(dir, "export.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range []struct{ name, content string }{
+		{"Calls.csv", `Call type,Date,Duration,Number,Contact,Location,Service
+Incoming,2024-01-15 10:30:00,00:02:45,+1234567890,Test Contact,Mobile,Phone`},
+		{"Messages/Alice.csv", `Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type
++1555123456,2024-01-01 12:00:00,,,,iMessage,Incoming,+1555123456,Alice,Read,,,Look at this!,Attachments/IMG_0001.jpeg,Image
++1555123456,2024-01-01 12:01:00,,,,SMS,Outgoing,,,Delivered,,,Hi there,,`},
+		{"Messages/Attachments/IMG_0001.jpeg", "jpeg data"},
+		{"__MACOSX/Messages/._Alice.csv", "resource fork"},
+		{"notes.csv", "foo,bar\n1,2"},
+	} {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", entry.name, err)
+		}
+		if _, err := io.WriteString(w, entry.content); err != nil {
+			t.Fatalf("failed to write %s: %v", entry.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	return archive
+}
+
+// TestConvertZip tests converting a ZIP archive of exports into a single result
+func TestConvertZip(t *testing.T) {
+	archive := writeZipExport(t, t.TempDir())
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithCsvFile(archive), WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	result, err := app.Convert()
+	if err != nil {
+		t.Fatalf("Convert() error = %v", err)
+	}
+	if result.FileType != MixedFile || result.Rows != 3 {
+		t.Errorf("expected mixed exports with 3 rows, got %v with %d rows", result.FileType, result.Rows)
+	}
+	if len(result.Calls.Call) != 1 || result.Calls.Count != "1" {
+		t.Errorf("expected 1 call, got %d with count %s", len(result.Calls.Call), result.Calls.Count)
+	}
+	if len(result.Messages.Sms) != 1 || len(result.Messages.Mms) != 1 || result.Messages.Count != "2" {
+		t.Fatalf("expected 1 SMS and 1 MMS, got %d SMS, %d MMS with count %s", len(result.Messages.Sms), len(result.Messages.Mms), result.Messages.Count)
+	}
+	var attachment *sbrdata.Part
+	for i, part := range result.Messages.Mms[0].Parts.Part {
+		if part.Ct == "image/jpeg" {
+			attachment = &result.Messages.Mms[0].Parts.Part[i]
+		}
+	}
+	if attachment == nil || attachment.Cl != "IMG_0001.jpeg" {
+		t.Errorf("expected attachment to be resolved in the archive, got %+v", result.Messages.Mms[0].Parts.Part)
+	}
+	expected := []Warning{{Message: filepath.Join(archive, "notes.csv") + ": unsupported file format, skipped"}}
+	if diff := cmp.Diff(expected, result.Warnings); diff != "" {
+		t.Errorf("warnings mismatch (-expected +got):\n%s", diff)
+	}
+
+	app, err = NewApplication(logger, WithCsvFile(archive), WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	streamed, stats, err := app.StreamImport(io.Discard)
+	if err != nil {
+		t.Fatalf("StreamImport() error = %v", err)
+	}
+	if streamed.FileType != MixedFile || stats.Added != 3 || streamed.Calls.Count != "1" || streamed.Messages.Count != "2" {
+		t.Errorf("expected 1 call and 2 messages to be streamed, got %v with %+v", streamed.FileType, stats)
+	}
+	if diff := cmp.Diff(expected, streamed.Warnings); diff != "" {
+		t.Errorf("streamed warnings mismatch (-expected +got):\n%s", diff)
+	}
+}
+
+// TestImportFilesZip tests importing a ZIP archive with one result per CSV file in the archive
+func TestImportFilesZip(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeZipExport(t, dir)
+	files, err := FindImportFiles(dir)
+	if err != nil {
+		t.Fatalf("FindImportFiles() error = %v", err)
+	}
+	if diff := cmp.Diff([]string{archive}, files); diff != "" {
+		t.Fatalf("files mismatch (-expected +got):\n%s", diff)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	app, err := NewApplication(logger, WithTimezone(time.UTC))
+	if err != nil {
+		t.Fatalf("failed to create application: %v", err)
+	}
+	results, err := app.ImportFiles(files...)
+	if err != nil {
+		t.Fatalf("ImportFiles() error = %v", err)
+	}
+	expected := []struct {
+		file  string
+		added int
+		err   error
+	}{
+		{file: "Calls.csv", added: 1},
+		{file: filepath.Join("Messages", "Alice.csv"), added: 2},
+		{file: "notes.csv"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, e := range expected {
+		r := results[i]
+		if r.File != filepath.Join(archive, e.file) || r.Stats.Added != e.added || !errors.Is(r.Err, e.err) {
+			t.Errorf("expected %s with %d added and error %v, got %s with %+v and error %v", e.file, e.added, e.err, r.File, r.Stats, r.Err)
+		}
+	}
+	if skipped := results[2].Result; skipped.FileType != UnknownFile || len(skipped.Warnings) != 1 {
+		t.Errorf("expected the file that is no export to be skipped with a warning, got %+v", skipped)
+	}
+
+	results, err = app.ImportFiles(filepath.Join(dir, "missing.zip"))
+	if err != nil || len(results) != 1 || !errors.Is(results[0].Err, os.ErrNotExist) {
+		t.Errorf("expected a missing archive to be reported in its result, got %+v, %v", results, err)
+	}
+	empty := filepath.Join(dir, "empty.zip")
+	if err := os.WriteFile(empty, []byte("PK\x05\x06"+strings.Repeat("\x00", 18)), 0644); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+	results, err = app.ImportFiles(empty)
+	if err != nil || len(results) != 1 || !errors.Is(results[0].Err, ErrNoImportFiles) {
+		t.Errorf("expected an archive without CSV files to fail with ErrNoImportFiles, got %+v, %v", results, err)
+	}
+}
+
+// TestBackups tests the rotation of collection file backups when the collection is saved
+func TestBackups(t *testing.T) {
+	tmpDir := t.TempDir()
+	collectionPath := filepath.Join(tmpDir, "collection.json")
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelError,
+	}))
+
+	if _, err := NewApplication(logger, WithBackups(-1)); !errors.Is(err, ErrNegativeBackups) {
+		t.Errorf("expected ErrNegativeBackups, got %v", err)
+	}
+
+	// every run adds one call, so the number of calls identifies the version of the file
+	for i := 1; i <= 4; i++ {
+		app, err := NewApplication(logger, WithCollectionFile(collectionPath), WithBackups(2))
+		if err != nil {
+			t.Fatalf("failed to create application: %v", err)
+		}
+		calls := &sbrdata.Calls{Call: []sbrdata.Call{{Number: "+1234567890", Date: strconv.Itoa(i), Type: "1", Duration: "60"}}}
+		if _, err := app.AppendCalls(calls); err != nil {
+			t.Fatalf("AppendCalls() error = %v", err)
+		}
+	}
+	for file, expected := range map[string]int{
+		collectionPath:        4,
+		collectionPath + ".1": 3,
+		collectionPath + ".2": 2,
+	} {
+		collection, err := sbrdata.LoadCollection(file)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", file, err)
+		}
+		if len(collection.Calls) != expected {
+			t.Errorf("%s: expected %d calls, got %d", filepath.Base(file), expected, len(collection.Calls))
+		}
+	}
+	if _, err := os.Stat(collectionPath + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+
+	// a failing write leaves the collection and its backups unchanged
+	before, err := os.ReadFile(collectionPath)
+	if err != nil {
+		t.Fatalf("failed to read collection: %v", err)
+	}
+	errWrite := errors.New("disk full")
+	err = writeFile(collectionPath, 2, func(w io.Writer) error {
+		_, _ = io.WriteString(w, `{"Key": "`)
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Errorf("expected write error, got %v", err)
+	}
+	after, err := os.ReadFile(collectionPath)
+	if err != nil || !bytes.Equal(before, after) {
+		t.Errorf("expected collection to be unchanged, got %v", err)
+	}
+	backup, err := sbrdata.LoadCollection(collectionPath + ".1")
+	if err != nil || len(backup.Calls) != 3 {
+		t.Errorf("expected backups to be unchanged, got %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.tmp"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("expected temporary files to be removed, found %v", matches)
+	}
+}
+
+// messageExport generates a message export with the given number of rows on the fly,
+// so the size of the input does not count towards the memory of the conversion. The
+// peak heap size is sampled while the export is read.
+type messageExport struct {
+	rows int
+	row  int
+	buf  bytes.Buffer
+	peak uint64
+}
+
+// Read implements io.Reader
+func (e *messageExport) Read(p []byte) (int, error) {
+	for e.buf.Len() < len(p) && e.row <= e.rows {
+		if e.row == 0 {
+			e.buf.WriteString("Chat Session,Message Date,Delivered Date,Read Date,Edited Date,Service,Type,Sender ID,Sender Name,Status,Replying to,Subject,Text,Attachment,Attachment type\n")
+		} else {
+			// sessions of 50 messages, alternating between incoming and outgoing messages
+			session := fmt.Sprintf("+1555%07d", e.row/50)
+			date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(e.row) * time.Minute).Format("2006-01-02 15:04:05")
+			if e.row%2 == 0 {
+				fmt.Fprintf(&e.buf, "%s,%s,,,,SMS,Incoming,%s,Contact %d,Read,,,Message number %d with some text,,\n", session, date, session, e.row/50, e.row)
+			} else {
+				fmt.Fprintf(&e.buf, "%s,%s,%s,,,SMS,Outgoing,,,Delivered,,,Reply number %d with some text,,\n", session, date, date, e.row)
+			}
+		}
+		if e.row%10000 == 0 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			e.peak = max(e.peak, stats.HeapAlloc)
+		}
+		e.row++
+	}
+	if e.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return e.buf.Read(p)
+}
+
+// BenchmarkConvertMessages measures converting and appending a growing message export in memory
+func BenchmarkConvertMessages(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, rows := range []int{10_000, 100_000, 400_000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			var peak uint64
+			for b.Loop() {
+				runtime.GC()
+				app, err := NewApplication(logger, WithTimezone(time.UTC))
+				if err != nil {
+					b.Fatal(err)
+				}
+				export := &messageExport{rows: rows}
+				result, err := app.ConvertReader(context.Background(), export)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := app.AppendResult(result); err != nil {
+					b.Fatal(err)
+				}
+				if err := app.AppendTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				peak = max(peak, export.peak)
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+// BenchmarkStreamMessages measures streaming a growing message export, the peak heap
+// size stays flat as the number of rows grows
+func BenchmarkStreamMessages(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, rows := range []int{10_000, 100_000, 400_000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			var peak uint64
+			for b.Loop() {
+				runtime.GC()
+				app, err := NewApplication(logger, WithTimezone(time.UTC))
+				if err != nil {
+					b.Fatal(err)
 				}
+				export := &messageExport{rows: rows}
+				if _, _, err := app.StreamReader(context.Background(), export, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				peak = max(peak, export.peak)
 			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+// samplePeakHeap samples the heap size until stop is closed and returns the peak on done
+func samplePeakHeap(stop <-chan struct{}, done chan<- uint64) {
+	var peak uint64
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		peak = max(peak, stats.HeapAlloc)
+		select {
+		case <-stop:
+			done <- peak
+			return
+		case <-ticker.C:
 		}
 	}
+}
 
-	// Verify sender name if specified
-	if expectedSender, ok := options["sender_name"]; ok {
-		for i, sms := range messageData.Sms {
-			// Check if sender name is set (either from Sender Name or Chat Session)
-			if sms.ContactName == "" {
-				t.Errorf("message %d: expected ContactName to be set", i)
+// BenchmarkStreamImportTagged measures a tagged streaming import of a growing message
+// export into a collection file already holding a tagged import of the same size. The
+// identities of the added records are spooled, so the peak heap size only grows with
+// the hashes kept to skip duplicates.
+func BenchmarkStreamImportTagged(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, rows := range []int{10_000, 100_000, 400_000} {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			tmpDir := b.TempDir()
+			exportPath := filepath.Join(tmpDir, "export.csv")
+			f, err := os.Create(exportPath)
+			if err != nil {
+				b.Fatal(err)
 			}
-			// For messages from the expected sender, verify the name matches
-			if strings.Contains(sms.ContactName, expectedSender) || strings.Contains(expectedSender, sms.ContactName) {
-				// Match found, this is expected
+			if _, err := io.Copy(f, &messageExport{rows: rows}); err != nil {
+				b.Fatal(err)
 			}
+			if err := f.Close(); err != nil {
+				b.Fatal(err)
+			}
+			collectionPath := filepath.Join(tmpDir, "collection.json")
+
+			var peak uint64
+			for i := 0; b.Loop(); i++ {
+				b.StopTimer()
+				for _, file := range []string{collectionPath, tagIndexFile(collectionPath)} {
+					if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+						b.Fatal(err)
+					}
+				}
+				// the previous import of the same size, shifted by a day so no record is a duplicate
+				app, err := NewApplication(logger, WithCsvFile(exportPath), WithCollectionFile(collectionPath), WithTimezone(time.FixedZone("", 86400)), WithTag("previous"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := app.StreamImport(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				b.StartTimer()
+
+				app, err = NewApplication(logger, WithCsvFile(exportPath), WithCollectionFile(collectionPath), WithTimezone(time.UTC), WithTag(fmt.Sprintf("run-%d", i)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				stop, done := make(chan struct{}), make(chan uint64)
+				go samplePeakHeap(stop, done)
+				_, stats, err := app.StreamImport(io.Discard)
+				close(stop)
+				peak = max(peak, <-done)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if stats.Added != rows {
+					b.Fatalf("expected %d added records, got %+v", rows, stats)
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+// BenchmarkParseTapback measures checking message bodies for reactions, which is done for
+// every message of an export
+func BenchmarkParseTapback(b *testing.B) {
+	bodies := []string{
+		"Sure! How about 3pm?",
+		"Have you seen the new photos from the trip?",
+		"Liked “Sure! How about 3pm?”",
+		"Hat „Bis morgen“ geliebt",
+	}
+	for b.Loop() {
+		for _, body := range bodies {
+			parseTapback(body)
 		}
 	}
 }
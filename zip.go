@@ -0,0 +1,199 @@
+package imazingtosbr
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// importSource is an export to convert, a CSV file or a CSV file of a ZIP archive
+type importSource struct {
+	// name of the export, entries of an archive are named by the archive and the entry
+	name string
+	// open opens the export for reading
+	open func() (io.ReadCloser, error)
+	// attachments holds the attachment files referenced by the export
+	attachments fs.FS
+	// archived is set for the CSV files of a ZIP archive
+	archived bool
+}
+
+// isZipFile returns true if the file is a ZIP archive according to its extension
+func isZipFile(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// importSources returns the exports of an import file: all CSV files of a ZIP archive
+// or the file itself. The returned function closes the archive once the exports are
+// converted.
+func (a *Application) importSources(file string) ([]importSource, func() error, error) {
+	if !isZipFile(file) {
+		return []importSource{{
+			name: file,
+			open: func() (io.ReadCloser, error) {
+				return os.Open(file)
+			},
+			attachments: a.importAttachments(file),
+		}}, func() error { return nil }, nil
+	}
+
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := zipCSVFiles(&archive.Reader)
+	if len(entries) == 0 {
+		_ = archive.Close()
+		return nil, nil, fmt.Errorf("%w: no CSV file in %s", ErrNoImportFiles, file)
+	}
+	sources := make([]importSource, 0, len(entries))
+	for _, entry := range entries {
+		attachments := a.attachments
+		if attachments == nil {
+			// attachments are referenced relative to the CSV file like in an export folder
+			attachments, err = fs.Sub(&archive.Reader, path.Dir(entry))
+			if err != nil {
+				_ = archive.Close()
+				return nil, nil, err
+			}
+		}
+		sources = append(sources, importSource{
+			name: filepath.Join(file, filepath.FromSlash(entry)),
+			open: func() (io.ReadCloser, error) {
+				return archive.Open(entry)
+			},
+			attachments: attachments,
+			archived:    true,
+		})
+	}
+	a.l.Debug("found CSV files in archive", "file", file, "count", len(sources))
+	return sources, archive.Close, nil
+}
+
+// zipCSVFiles returns the names of the CSV files of the archive sorted by name, skipping
+// the metadata macOS adds to archives
+func zipCSVFiles(archive *zip.Reader) []string {
+	entries := make([]string, 0)
+	for _, f := range archive.File {
+		name := f.Name
+		if f.FileInfo().IsDir() || !fs.ValidPath(name) || !strings.EqualFold(path.Ext(name), ".csv") {
+			continue
+		}
+		if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), "._") {
+			continue
+		}
+		entries = append(entries, name)
+	}
+	slices.Sort(entries)
+	return entries
+}
+
+// convertSource converts the export, handing its records to sink if it is not nil. A CSV
+// file of an archive that is no iMazing export is skipped, its result only holds a warning.
+func (a *Application) convertSource(src importSource, sink recordSink) (*ConversionResult, error) {
+	a.l.Debug("converting file", "file", src.name)
+	r, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := r.Close()
+		if err != nil {
+			a.l.Error("error closing file", "err", err)
+		}
+	}()
+
+	result, err := a.convert(context.Background(), r, src.attachments, sink)
+	if !src.archived {
+		return result, err
+	}
+	if errors.Is(err, ErrUnsupportedFileFormat) {
+		a.l.Debug("skipping file", "file", src.name, "err", err)
+		result = newConversionResult(UnknownFile)
+		result.Warnings = append(result.Warnings, Warning{Message: fmt.Sprintf("%s: %v, skipped", src.name, err)})
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range result.SkippedRows {
+		row.File = src.name
+	}
+	return result, nil
+}
+
+// convertArchive converts all supported CSV files of an archive to a single result, see
+// mergeResults. CSV files that are no iMazing export are reported as warnings.
+func (a *Application) convertArchive(sources []importSource) (*ConversionResult, error) {
+	results := make([]*ConversionResult, 0, len(sources))
+	for _, src := range sources {
+		result, err := a.convertSource(src, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.name, err)
+		}
+		results = append(results, result)
+	}
+	merged := mergeResults(results)
+	if merged.FileType == UnknownFile {
+		return nil, ErrUnsupportedFileFormat
+	}
+	return merged, nil
+}
+
+// mergeResults combines the results of the exports of an archive. The file type is the
+// type of all exports, or MixedFile if the archive holds call history and message exports;
+// skipped files do not count. Calls and messages hold the records of all exports.
+func mergeResults(results []*ConversionResult) *ConversionResult {
+	merged := newConversionResult(UnknownFile)
+	for _, result := range results {
+		switch merged.FileType {
+		case UnknownFile:
+			merged.FileType = result.FileType
+		case result.FileType, MixedFile:
+		default:
+			if result.FileType != UnknownFile {
+				merged.FileType = MixedFile
+			}
+		}
+		mergeResult(merged, result)
+	}
+	return merged
+}
+
+// mergeResult adds the records and statistics of result to merged
+func mergeResult(merged, result *ConversionResult) {
+	merged.Calls.Call = append(merged.Calls.Call, result.Calls.Call...)
+	merged.Calls.Count = addCounts(merged.Calls.Count, result.Calls.Count)
+	merged.Messages.Sms = append(merged.Messages.Sms, result.Messages.Sms...)
+	merged.Messages.Mms = append(merged.Messages.Mms, result.Messages.Mms...)
+	merged.Messages.Count = addCounts(merged.Messages.Count, result.Messages.Count)
+	merged.Rows += result.Rows
+	for service, count := range result.SkippedCalls {
+		merged.SkippedCalls[service] += count
+	}
+	for service, count := range result.RewrittenCalls {
+		merged.RewrittenCalls[service] += count
+	}
+	merged.Tapbacks.Kept += result.Tapbacks.Kept
+	merged.Tapbacks.Dropped += result.Tapbacks.Dropped
+	merged.Tapbacks.Folded += result.Tapbacks.Folded
+	merged.Replies = append(merged.Replies, result.Replies...)
+	merged.Warnings = append(merged.Warnings, result.Warnings...)
+	merged.SkippedRows = append(merged.SkippedRows, result.SkippedRows...)
+}
+
+// addCounts adds two record counts of the collection format
+func addCounts(a, b string) string {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	return strconv.Itoa(x + y)
+}